@@ -0,0 +1,76 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// Paths of the service account credentials mounted into pods, the defaults
+// of -api-token-file and -api-ca-file.
+const (
+	defaultTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// newAPIClient returns a client for the API server of the cluster the pod
+// runs in, trusting the CA in caFile and authenticating with the token in
+// tokenFile. Unlike k8s.NewInClusterClient, the token is read again for
+// every request, as the kubelet rotates projected tokens.
+func newAPIClient(tokenFile, caFile string) (*k8s.Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("unable to load in-cluster configuration, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
+	}
+	if _, err := readToken(tokenFile); err != nil {
+		return nil, err
+	}
+
+	client, err := k8s.NewClient(&k8s.Config{
+		Clusters: []k8s.NamedCluster{{
+			Name: "in-cluster",
+			Cluster: k8s.Cluster{
+				Server:               "https://" + net.JoinHostPort(host, port),
+				CertificateAuthority: caFile,
+			},
+		}},
+		AuthInfos: []k8s.NamedAuthInfo{{Name: "service-account"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	client.SetHeaders = func(h http.Header) error {
+		token, err := readToken(tokenFile)
+		if err != nil {
+			return err
+		}
+		h.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	return client, nil
+}
+
+func readToken(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the token: %s", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
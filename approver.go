@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+type deploymentStatus struct {
+	Status struct {
+		Replicas      int32 `json:"replicas"`
+		ReadyReplicas int32 `json:"readyReplicas"`
+	} `json:"status"`
+}
+
+type lease struct {
+	Spec struct {
+		HolderIdentity       *string    `json:"holderIdentity"`
+		LeaseDurationSeconds *int32     `json:"leaseDurationSeconds"`
+		RenewTime            *time.Time `json:"renewTime"`
+	} `json:"spec"`
+}
+
+// waitForApprover waits up to timeout for the approvers of -approver-check
+// to be running, or checks them once if timeout is 0. Requests nobody
+// approves otherwise only fail once they time out.
+func waitForApprover(client *k8s.Client, checks []string, timeout time.Duration) error {
+	start := clk.Now()
+	waiting := newLogThrottle()
+	for {
+		var err error
+		for _, check := range checks {
+			if err = checkApprover(client, check); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if since(start) >= timeout {
+			return fmt.Errorf("approver not running: %s", err)
+		}
+		waiting.Printf("waiting for the approver: %s", err)
+		clk.Sleep(5 * time.Second)
+	}
+}
+
+// checkApprover returns an error unless the approver described by check
+// is running: deployment:namespace/name has ready replicas,
+// lease:namespace/name is held and was renewed in time, or an http(s) URL
+// answers 200.
+func checkApprover(client *k8s.Client, check string) error {
+	if strings.HasPrefix(check, "http://") || strings.HasPrefix(check, "https://") {
+		c := &http.Client{Timeout: 5 * time.Second}
+		resp, err := c.Get(check)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: unexpected status %s", check, resp.Status)
+		}
+		return nil
+	}
+
+	s := strings.SplitN(check, ":", 2)
+	if len(s) != 2 {
+		return fmt.Errorf("invalid check %q, expected deployment:namespace/name, lease:namespace/name or a URL", check)
+	}
+	ref := strings.SplitN(s[1], "/", 2)
+	if len(ref) != 2 || ref[0] == "" || ref[1] == "" {
+		return fmt.Errorf("invalid %s %q, expected namespace/name", s[0], s[1])
+	}
+	switch s[0] {
+	case "deployment":
+		var d deploymentStatus
+		if err := apiJSON(client, "GET", "/apis/apps/v1/namespaces/"+ref[0]+"/deployments/"+ref[1], nil, &d); err != nil {
+			return fmt.Errorf("deployment %s: %s", s[1], err)
+		}
+		if d.Status.ReadyReplicas == 0 {
+			return fmt.Errorf("deployment %s has none of its %d replicas ready", s[1], d.Status.Replicas)
+		}
+	case "lease":
+		var l lease
+		if err := apiJSON(client, "GET", "/apis/coordination.k8s.io/v1/namespaces/"+ref[0]+"/leases/"+ref[1], nil, &l); err != nil {
+			return fmt.Errorf("lease %s: %s", s[1], err)
+		}
+		if l.Spec.HolderIdentity == nil || *l.Spec.HolderIdentity == "" {
+			return fmt.Errorf("lease %s is not held", s[1])
+		}
+		if l.Spec.RenewTime != nil && l.Spec.LeaseDurationSeconds != nil {
+			expiry := l.Spec.RenewTime.Add(time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second)
+			if clk.Now().After(expiry) {
+				return fmt.Errorf("lease %s held by %s expired at %s", s[1], *l.Spec.HolderIdentity, expiry.UTC())
+			}
+		}
+	default:
+		return fmt.Errorf("invalid check %q, expected deployment:namespace/name, lease:namespace/name or a URL", check)
+	}
+	return nil
+}
+
+// gateOnApprover makes sure the approver is running before requesting
+// certificates, if -approver-check is set.
+func gateOnApprover(client *k8s.Client) {
+	if approverChecks == "" {
+		return
+	}
+	if err := waitForApprover(client, strings.Split(approverChecks, ","), approverWait); err != nil {
+		log.Fatal(err)
+	}
+}
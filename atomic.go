@@ -0,0 +1,82 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With -atomic-writes the files of a run are written to a hidden staging
+// directory in the target directory and then published all at once, the
+// way the kubelet updates secret volumes: ..data is a symlink to the
+// current staging directory, each file is a symlink into ..data and the
+// ready file is created last. Containers sharing the volume wait for ready
+// and never see a key without its certificate, or a partial file.
+const (
+	atomicDataLink = "..data"
+	atomicReady    = "ready"
+)
+
+// stageDir creates a staging directory in dir for the files of this run.
+func stageDir(dir string) (string, error) {
+	staging, err := ioutil.TempDir(dir, "..")
+	if err != nil {
+		return "", err
+	}
+	// Readers may run under other UIDs.
+	return staging, os.Chmod(staging, 0755)
+}
+
+// publishDir makes the files in staging, created by stageDir, visible in
+// dir and removes the staging directories of earlier runs.
+func publishDir(dir, staging string) error {
+	files, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+
+	// Renaming a symlink over another one is atomic, readers see either
+	// the previous or the new target.
+	link := func(target, name string) error {
+		tmp := filepath.Join(dir, ".."+name+".tmp")
+		os.Remove(tmp)
+		if err := os.Symlink(target, tmp); err != nil {
+			return err
+		}
+		return os.Rename(tmp, filepath.Join(dir, name))
+	}
+
+	if err := link(filepath.Base(staging), atomicDataLink); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := link(filepath.Join(atomicDataLink, f.Name()), f.Name()); err != nil {
+			return err
+		}
+	}
+
+	// Files still open by readers stay readable after their removal.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "..") && e.Name() != filepath.Base(staging) {
+			os.RemoveAll(filepath.Join(dir, e.Name()))
+		}
+	}
+
+	return writeFile(filepath.Join(dir, atomicReady), []byte(clk.Now().UTC().Format("2006-01-02T15:04:05Z")+"\n"), false)
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+)
+
+// auditAnnotation is the Secret annotation holding the most recent audit
+// entries of the certificates stored in it.
+const auditAnnotation = "certificate-init-container/audit"
+
+// The annotations holding how long the slowest of the certificates stored
+// in a Secret, or obtained by a pod, waited for approval and issuance.
+const (
+	approvalLatencyAnnotation = "certificate-init-container/time-to-approval"
+	issuanceLatencyAnnotation = "certificate-init-container/time-to-issuance"
+)
+
+// An auditEntry records the issuance of a single certificate.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Pod      string    `json:"pod"`
+	Request  string    `json:"request"`
+	UID      string    `json:"uid,omitempty"`
+	Issuer   string    `json:"issuer"`
+	Approval string    `json:"approval,omitempty"`
+	Serial   string    `json:"serial"`
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+func newAuditEntry(c *certificate) (*auditEntry, error) {
+	block, _ := pem.Decode(c.cert)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate found in %s", c.certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", c.certFile, err)
+	}
+	return &auditEntry{
+		Time:     clk.Now().UTC(),
+		Pod:      namespace + "/" + podName,
+		Request:  c.name,
+		UID:      c.uid,
+		Issuer:   issuerName,
+		Approval: c.approval,
+		Serial:   cert.SerialNumber.Text(16),
+		Subject:  cert.Subject.String(),
+		NotAfter: cert.NotAfter,
+	}, nil
+}
+
+// appendAuditLog appends entries to the file at name, one JSON object per
+// line.
+func appendAuditLog(name string, entries []*auditEntry) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// appendAuditAnnotation adds entries to the history kept in the annotations,
+// keeping no more than max entries.
+func appendAuditAnnotation(annotations map[string]string, entries []*auditEntry, max int) error {
+	var history []*auditEntry
+	if v, ok := annotations[auditAnnotation]; ok {
+		// A history that can't be read is replaced rather than failing
+		// the issuance.
+		json.Unmarshal([]byte(v), &history)
+	}
+	history = append(history, entries...)
+	if len(history) > max {
+		history = history[len(history)-max:]
+	}
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	annotations[auditAnnotation] = string(b)
+	return nil
+}
+
+// setLatencyAnnotations records in annotations how long the slowest of
+// certs waited for approval and issuance.
+func setLatencyAnnotations(annotations map[string]string, certs []*certificate) {
+	var approval, issuance time.Duration
+	for _, c := range certs {
+		if c.approvedAfter > approval {
+			approval = c.approvedAfter
+		}
+		if c.issuedAfter > issuance {
+			issuance = c.issuedAfter
+		}
+	}
+	if approval > 0 {
+		annotations[approvalLatencyAnnotation] = approval.Round(time.Millisecond).String()
+	}
+	annotations[issuanceLatencyAnnotation] = issuance.Round(time.Millisecond).String()
+}
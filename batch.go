@@ -0,0 +1,209 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	apiv1 "github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+// An identity is a secret to provision in batch mode along with the names
+// its certificate is requested for.
+type identity struct {
+	secretName  string
+	dnsNames    []string
+	ipAddresses []net.IP
+}
+
+// newIdentity returns the identity stored in secretName, names is a comma
+// separated list of its DNS names and IP addresses.
+func newIdentity(secretName, names string) *identity {
+	id := &identity{secretName: secretName}
+	for _, n := range strings.Split(names, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		if ip := net.ParseIP(n); ip != nil {
+			id.ipAddresses = append(id.ipAddresses, ip)
+			continue
+		}
+		id.dnsNames = append(id.dnsNames, n)
+	}
+	return id
+}
+
+// readIdentities reads the identities to provision from a ConfigMap. Each
+// key names a secret, its value is a comma separated list of the DNS names
+// and IP addresses of the certificate, the first one being used as CN.
+func readIdentities(client *k8s.Client, name, namespace string) ([]*identity, error) {
+	cm, err := client.CoreV1().GetConfigMap(context.Background(), name, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configmap %s: %s", name, err)
+	}
+
+	var identities []*identity
+	for secretName, names := range cm.GetData() {
+		id := newIdentity(secretName, names)
+		if len(id.dnsNames) == 0 {
+			return nil, fmt.Errorf("no DNS names for %s in configmap %s", secretName, name)
+		}
+		identities = append(identities, id)
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].secretName < identities[j].secretName
+	})
+	return identities, nil
+}
+
+// runBatch provisions the secrets listed in the ConfigMap. No more than
+// concurrency requests are pending at a time and no two are submitted
+// within interval of each other, to go easy on the issuer and whoever
+// approves the requests. Secrets that already hold credentials are left
+// alone, missing ones are created.
+func runBatch(client *k8s.Client, iss issuer, configMap string, concurrency int, interval time.Duration) error {
+	identities, err := readIdentities(client, configMap, namespace)
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	log.Printf("provisioning %d secrets from configmap %s, %d at a time", len(identities), configMap, concurrency)
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+		issued int
+		skip   int
+	)
+	sem := make(chan struct{}, concurrency)
+	for n, id := range identities {
+		if n > 0 && interval > 0 {
+			clk.Sleep(interval)
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id *identity) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ok, err := provision(client, iss, id, &mu)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				log.Printf("%s: failed: %s", id.secretName, err)
+				failed = append(failed, id.secretName)
+			case ok:
+				log.Printf("%s: issued", id.secretName)
+				issued++
+			default:
+				log.Printf("%s: present, skipped", id.secretName)
+				skip++
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	log.Printf("batch done: %d issued, %d skipped, %d failed", issued, skip, len(failed))
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("unable to provision %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// provision obtains a certificate for id and stores it in its secret,
+// unless the secret already holds credentials. It reports whether a
+// certificate was issued. mu serializes writes to the audit log.
+func provision(client *k8s.Client, iss issuer, id *identity, mu *sync.Mutex) (bool, error) {
+	secret, err := client.CoreV1().GetSecret(context.Background(), id.secretName, namespace)
+	if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == 404 {
+		secret = &apiv1.Secret{
+			Metadata: &v1.ObjectMeta{
+				Name:      k8s.String(id.secretName),
+				Namespace: k8s.String(namespace),
+			},
+			Type: k8s.String("kubernetes.io/tls"),
+		}
+	} else if err != nil {
+		return false, fmt.Errorf("unable to read secret: %s", err)
+	}
+
+	data := secret.GetData()
+	present := true
+	for _, file := range []string{"tls.key", "tls.crt", "ca.crt"} {
+		if _, ok := data[file]; !ok {
+			present = false
+		}
+	}
+	if present {
+		return false, nil
+	}
+
+	c := &certificate{
+		name:        fmt.Sprintf("%s-%s", id.secretName, namespace),
+		keyFile:     "tls.key",
+		csrFile:     "tls.csr",
+		certFile:    "tls.crt",
+		subject:     subjectName(id.dnsNames[0]),
+		dnsNames:    id.dnsNames,
+		ipAddresses: id.ipAddresses,
+		usages:      defaultUsages(),
+	}
+	c.setOutputFiles(false)
+	log.Printf("%s: requesting a certificate for %s", id.secretName, strings.Join(c.dnsNames, ", "))
+	if err := c.obtain(iss); err != nil {
+		return false, err
+	}
+
+	var audit []*auditEntry
+	if auditLog != "" || auditHistory > 0 {
+		e, err := newAuditEntry(c)
+		if err != nil {
+			return false, fmt.Errorf("unable to record the issuance: %s", err)
+		}
+		audit = append(audit, e)
+	}
+	if auditLog != "" {
+		mu.Lock()
+		err := appendAuditLog(auditLog, audit)
+		mu.Unlock()
+		if err != nil {
+			return false, fmt.Errorf("unable to write to %s: %s", auditLog, err)
+		}
+	}
+
+	ca, err := iss.CA()
+	if err != nil {
+		return false, fmt.Errorf("unable to get the CA: %s", err)
+	}
+	if err := writeSecret(client, secret, []*certificate{c}, "ca.crt", ca, audit); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// maxRetryDelay caps the backoff between retries of a failed request.
+const maxRetryDelay = time.Minute
+
+// breakerIssuer retries failed requests with exponential backoff and stops
+// contacting the issuer altogether once too many of them failed in a row,
+// so a CA that is down sees a bounded number of requests from every pod
+// rather than a steady stream of them. Only transient errors are retried
+// and counted, a request turned down would only be turned down again.
+type breakerIssuer struct {
+	issuer
+
+	retries     int
+	maxFailures int
+
+	mu       sync.Mutex
+	failures int
+	lastErr  error
+}
+
+// withRetries wraps iss according to -issuer-retries and
+// -issuer-max-failures, or returns it as is if both are disabled.
+func withRetries(iss issuer) issuer {
+	if issuerRetries <= 0 && issuerMaxFailures <= 0 {
+		return iss
+	}
+	return &breakerIssuer{
+		issuer:      iss,
+		retries:     issuerRetries,
+		maxFailures: issuerMaxFailures,
+	}
+}
+
+// Issue submits r to the wrapped issuer, retrying up to b.retries times.
+// Once the breaker is open every request fails without being submitted.
+func (b *breakerIssuer) Issue(r *request) ([]byte, error) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if err := b.open(); err != nil {
+			return nil, err
+		}
+
+		cert, err := b.issuer.Issue(r)
+		if err == nil {
+			b.mu.Lock()
+			b.failures = 0
+			b.mu.Unlock()
+			return cert, nil
+		}
+		if !isTransient(err) {
+			return nil, err
+		}
+
+		b.mu.Lock()
+		b.failures++
+		b.lastErr = err
+		failures := b.failures
+		b.mu.Unlock()
+
+		if attempt >= b.retries {
+			return nil, err
+		}
+		log.Printf("request %s failed (%d consecutive failures): %s; retrying in %s", r.name, failures, err, delay)
+		clk.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// open returns an error if the issuer failed too often in a row to be
+// contacted again.
+func (b *breakerIssuer) open() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxFailures > 0 && b.failures >= b.maxFailures {
+		return fmt.Errorf("giving up on the %s issuer after %d consecutive failures, last one: %s", issuerName, b.failures, b.lastErr)
+	}
+	return nil
+}
+
+// A transientError is an error that wraps a transient one with context.
+type transientError struct {
+	error
+}
+
+// retryable returns wrapped, an error adding context to err, still marked
+// as transient if err is.
+func retryable(err, wrapped error) error {
+	if isTransient(err) {
+		return transientError{wrapped}
+	}
+	return wrapped
+}
+
+// isTransient tells whether err is worth retrying: the issuer could not be
+// reached, timed out, was overloaded or failed internally. Denials, policy
+// rejections and invalid requests are not.
+func isTransient(err error) bool {
+	switch err := err.(type) {
+	case transientError:
+		return true
+	case *url.Error, net.Error:
+		return true
+	case *k8s.APIError:
+		return transientStatus(err.Code)
+	}
+	return false
+}
+
+// transientStatus tells whether an HTTP status code is worth retrying.
+func transientStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
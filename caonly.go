@@ -0,0 +1,115 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// trustedCAs returns the CA of iss along with the bundles of -rotation-cas
+// and -federated-cas, the CAs to write as -ca-file.
+func trustedCAs(client *k8s.Client, iss issuer) ([]byte, error) {
+	ca, err := iss.CA()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the CA: %s", err)
+	}
+
+	// CAs to trust besides the issuer's.
+	var extraCAs []byte
+	if federatedCAs != "" {
+		extraCAs = fetchFederatedBundles(client, strings.Split(federatedCAs, ","), federationCache)
+	}
+	if rotationCAs != "" {
+		bundles, err := readRotationCAs(client, strings.Split(rotationCAs, ","))
+		if err != nil {
+			return nil, err
+		}
+		extraCAs = mergeBundles(append(bundles, extraCAs)...)
+	}
+	if extraCAs != nil {
+		ca = mergeBundles(ca, extraCAs)
+	}
+	return ca, nil
+}
+
+// writeCAOnly writes the CAs to trust, and nothing else, as -ca-file and,
+// with -out-format=pkcs12, truststore.p12, to dir or to -secret-name.
+func writeCAOnly(client *k8s.Client, iss issuer, dir string) error {
+	ca, err := trustedCAs(client, iss)
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{caFileName: ca}
+	if writePKCS12 {
+		roots, err := parseChain(ca)
+		if err != nil {
+			return fmt.Errorf("unable to parse the CA: %s", err)
+		}
+		if files["truststore.p12"], err = encodeTruststore(roots, keystorePassword); err != nil {
+			return fmt.Errorf("unable to encode truststore.p12: %s", err)
+		}
+	}
+
+	if trustBundleFile != "" {
+		if err := updateTrustBundle(trustBundleFile, ca, issuerName); err != nil {
+			return fmt.Errorf("unable to update the trust bundle %s: %s", trustBundleFile, err)
+		}
+		log.Printf("updated %s", trustBundleFile)
+	}
+
+	if dir != "" {
+		for name, data := range files {
+			file := path.Join(dir, name)
+			if err := writeFile(file, data, false); err != nil {
+				return fmt.Errorf("unable to write to %s: %s", file, err)
+			}
+			log.Printf("wrote %s", file)
+		}
+	}
+
+	if secretName != "" {
+		secret, err := client.CoreV1().GetSecret(context.Background(), secretName, namespace)
+		if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusNotFound {
+			if !createSecret {
+				return fmt.Errorf("secret %s not found, create it or pass -create-secret", secretName)
+			}
+			if secret, err = newSecret(secretName, false); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return fmt.Errorf("unable to read secret %s: %s", secretName, err)
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		for name, data := range files {
+			secret.Data[name] = data
+		}
+		if secret.Metadata.GetResourceVersion() == "" {
+			_, err = client.CoreV1().CreateSecret(context.Background(), secret)
+		} else {
+			_, err = client.CoreV1().UpdateSecret(context.Background(), secret)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to store the CA in secret %s: %s", secretName, err)
+		}
+		log.Printf("Stored the CA in secret: (%s)", secretName)
+	}
+	return nil
+}
@@ -0,0 +1,714 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	serverUsages = []string{"digital signature", "key encipherment", "server auth"}
+	clientUsages = []string{"digital signature", "key encipherment", "client auth"}
+)
+
+// builtinSignerUsages are the usages the built-in signers of Kubernetes
+// sign certificates for, they refuse requests for any other.
+var builtinSignerUsages = map[string][]string{
+	"kubernetes.io/kube-apiserver-client":         clientUsages,
+	"kubernetes.io/kube-apiserver-client-kubelet": clientUsages,
+	"kubernetes.io/kubelet-serving":               serverUsages,
+}
+
+// defaultUsages returns the usages to request a certificate for: serving
+// and client authentication, unless the kubernetes issuer addresses a
+// built-in signer that only signs one of them.
+func defaultUsages() []string {
+	if usages, ok := builtinSignerUsages[signerName]; ok && issuerName == "kubernetes" {
+		return usages
+	}
+	return []string{"digital signature", "key encipherment", "server auth", "client auth"}
+}
+
+// A certificate is a key pair that gets signed by an issuer, along with the
+// file names its key, request and certificate are stored under.
+type certificate struct {
+	name string
+
+	// dir is where the files are written, if set.
+	dir            string
+	keyFile        string
+	csrFile        string
+	certFile       string
+	p7bFile        string
+	pubFile        string
+	sshFile        string
+	jwksFile       string
+	combinedFile   string
+	caChainFile    string
+	provenanceFile string
+	verifyFile     string
+	p12File        string
+	chainFile      string
+	fullchainFile  string
+	haproxyFile    string
+	subject        pkix.Name
+	dnsNames       []string
+	ipAddresses    []net.IP
+	uris           []*url.URL
+	otherNames     []otherName
+	usages         []string
+
+	// keyAlgorithm and keyFormat override -key-algorithm and -key-format
+	// for this certificate, if set.
+	keyAlgorithm string
+	keyFormat    string
+
+	// request is a PEM encoded certificate request generated elsewhere,
+	// submitted instead of generating a key, if set.
+	request []byte
+
+	// Set by obtain. atRest is key as written to files and secrets,
+	// encrypted if -key-passphrase-file or KEY_PASSPHRASE are set.
+	key      []byte
+	atRest   []byte
+	cert     []byte
+	approval string
+	uid      string
+
+	// keyCreated is when key was generated and renewals how often it was
+	// reused since. With reuseKey set, obtain requests a certificate for
+	// key instead of generating a new one, see -rekey-every.
+	keyCreated time.Time
+	renewals   int
+	reuseKey   bool
+	rekeyed    bool
+
+	// How long the request waited for approval, if known, and for the
+	// certificate.
+	approvedAfter time.Duration
+	issuedAfter   time.Duration
+
+	// certOut is the certificate as written to files and secrets, only
+	// the leaf with -leaf-only.
+	certOut []byte
+
+	// outputs holds the files derived from the key and certificate,
+	// written and stored next to them.
+	outputs map[string][]byte
+}
+
+// obtain generates a private key and a certificate request for c, unless it
+// was given one, has the request signed by iss and writes the results to c.dir, if set.
+func (c *certificate) obtain(iss issuer) error {
+	// A request generated elsewhere, e.g. by an HSM sidecar, is submitted
+	// as is, its key never leaves its holder.
+	var csr *x509.CertificateRequest
+	if c.request != nil {
+		var err error
+		csr, err = parseRequest(c.request)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate request: %s", err)
+		}
+	}
+
+	if requestPolicy != nil {
+		// Such a request is checked for what it asks for, not for what
+		// the flags would have asked for.
+		subject, dnsNames, ipAddresses, uris := c.subject, c.dnsNames, c.ipAddresses, c.uris
+		if csr != nil {
+			subject, dnsNames, ipAddresses, uris = csr.Subject, csr.DNSNames, csr.IPAddresses, csr.URIs
+		}
+		names := append([]string(nil), dnsNames...)
+		for _, ip := range ipAddresses {
+			names = append(names, ip.String())
+		}
+		for _, u := range uris {
+			names = append(names, u.String())
+		}
+		var signer string
+		if issuerName == "kubernetes" {
+			signer = signerName
+		}
+		if err := requestPolicy.check(namespace, issuerName, signer, subject.CommonName, names); err != nil {
+			return err
+		}
+	}
+
+	var (
+		pub                     crypto.PublicKey
+		certificateRequestBytes []byte
+	)
+	if csr != nil {
+		pub, certificateRequestBytes = csr.PublicKey, c.request
+	} else {
+		var err error
+		pub, certificateRequestBytes, err = c.generate()
+		if err != nil {
+			return err
+		}
+	}
+	if debugArtifactsDir != "" {
+		if err := writeDebugArtifacts(debugArtifactsDir, c, certificateRequestBytes); err != nil {
+			return fmt.Errorf("unable to write the debug artifacts: %s", err)
+		}
+	}
+
+	// Submit the certificate request to the issuer, wait for it to be signed,
+	// then save the signed certificate to the file system.
+	r := &request{
+		name:     c.name,
+		csr:      certificateRequestBytes,
+		dnsNames: c.dnsNames,
+		usages:   c.usages,
+		backdate: notBeforeBackdate,
+		duration: certDuration,
+	}
+	start := clk.Now()
+	var err error
+	c.cert, err = iss.Issue(r)
+	if err != nil {
+		return err
+	}
+	c.approval = r.approval
+	c.uid = r.uid
+	c.approvedAfter = r.approvedAfter
+	c.issuedAfter = since(start)
+
+	if fetchIntermediates || maxChainDepth > 0 || len(pinnedIssuers) > 0 || pinIssuerSubject != "" {
+		ca, err := iss.CA()
+		if err != nil {
+			return fmt.Errorf("unable to get the CA: %s", err)
+		}
+		if fetchIntermediates {
+			c.cert, err = completeChain(c.cert, ca)
+			if err != nil {
+				return fmt.Errorf("unable to complete the certificate chain: %s", err)
+			}
+		}
+		if err := checkIssuer(c.cert, ca, maxChainDepth, pinnedIssuers, pinIssuerSubject); err != nil {
+			return fmt.Errorf("refusing the certificate for %s: %s", c.name, err)
+		}
+	}
+
+	// Signers may prune or alter what was asked for, which is better
+	// noticed now than as a TLS error at runtime.
+	chain, err := parseChain(c.cert)
+	if err != nil {
+		return fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+	}
+	grant := diffGrant(c, chain[0])
+	log.Printf("granted: %s", grant)
+	if lifetime := chain[0].NotAfter.Sub(chain[0].NotBefore); certDuration > 0 {
+		log.Printf("certificate for %s is valid for %s, %s was requested", c.name, lifetime, certDuration)
+	} else {
+		log.Printf("certificate for %s is valid for %s", c.name, lifetime)
+	}
+	if requireSANs {
+		if missing := grant.names(); len(missing) > 0 {
+			return fmt.Errorf("refusing the certificate for %s: the signer left out %s", c.name, strings.Join(missing, ", "))
+		}
+	}
+
+	// Guard against a misconfigured signer handing out certificates that
+	// outlive the policy.
+	if maxDuration > 0 {
+		if err := checkLifetime(c.cert, maxDuration); err != nil {
+			return fmt.Errorf("refusing the certificate for %s: %s", c.name, err)
+		}
+	}
+
+	if validateExec != "" {
+		if err := runValidator(validateExec, c); err != nil {
+			return fmt.Errorf("refusing the certificate for %s: %s", c.name, err)
+		}
+	}
+
+	// Prove the key and chain work together in a real handshake before
+	// the application is started with them.
+	if handshakeTest && c.key != nil && hasExtKeyUsage(chain[0], x509.ExtKeyUsageServerAuth) {
+		ca, err := iss.CA()
+		if err != nil {
+			return fmt.Errorf("unable to get the CA: %s", err)
+		}
+		if err := testHandshake(c, ca); err != nil {
+			return fmt.Errorf("refusing the certificate for %s: %s", c.name, err)
+		}
+	}
+
+	if err := c.derive(iss, pub); err != nil {
+		return err
+	}
+
+	if c.dir != "" {
+		certFile := path.Join(c.dir, c.certFile)
+		if err := writeFile(certFile, encodeStored(c.certOut), false); err != nil {
+			return fmt.Errorf("unable to write to %s: %s", certFile, err)
+		}
+		log.Printf("wrote %s", certFile)
+
+		for name, data := range c.outputs {
+			file := path.Join(c.dir, name)
+			if err := writeFile(file, data, name == c.combinedFile || name == c.haproxyFile || name == c.p12File); err != nil {
+				return fmt.Errorf("unable to write to %s: %s", file, err)
+			}
+			log.Printf("wrote %s", file)
+		}
+	}
+
+	return nil
+}
+
+// generate generates a private key and a certificate request for c, returning
+// the public key and the PEM encoded request. Both are written to c.dir,
+// if set.
+func (c *certificate) generate() (crypto.PublicKey, []byte, error) {
+	// Generate a private key, pem encode it, and save it to the filesystem.
+	// The private key will be used to create a certificate signing request (csr)
+	// that will be submitted to a Kubernetes CA to obtain a TLS certificate.
+	// On renewals the key may be kept, see -rekey-every.
+	var (
+		key crypto.Signer
+		err error
+	)
+	if c.reuseKey && c.key != nil {
+		key, err = parseKeyPEM(c.key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse the private key to reuse: %s", err)
+		}
+		c.renewals++
+		c.rekeyed = false
+		log.Printf("reusing the private key of %s generated at %s", c.name, c.keyCreated.UTC())
+	} else {
+		algorithm, format := keyAlgorithm, keyFormat
+		if c.keyAlgorithm != "" {
+			algorithm, format = c.keyAlgorithm, c.keyFormat
+		}
+		key, err = generateKey(algorithm)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to genarate the private key: %s", err)
+		}
+
+		ptype, pkey, err := marshalPrivateKey(key, format)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c.key = pem.EncodeToMemory(&pem.Block{
+			Type:  ptype,
+			Bytes: pkey,
+		})
+		c.keyCreated = clk.Now()
+		c.renewals = 0
+		c.rekeyed = true
+	}
+
+	c.atRest = c.key
+	if keyPassphrase != "" {
+		if c.atRest, err = encryptKeyPEM(c.key, keyPassphrase); err != nil {
+			return nil, nil, fmt.Errorf("unable to encrypt the private key: %s", err)
+		}
+	}
+
+	if c.dir != "" {
+		keyFile := path.Join(c.dir, c.keyFile)
+		if err := writeFile(keyFile, encodeStored(c.atRest), true); err != nil {
+			return nil, nil, fmt.Errorf("unable to write to %s: %s", keyFile, err)
+		}
+
+		log.Printf("wrote %s", keyFile)
+	}
+
+	// Generate the certificate request, pem encode it, and save it to the filesystem.
+	certificateRequestTemplate := x509.CertificateRequest{
+		Subject:     c.subject,
+		DNSNames:    c.dnsNames,
+		IPAddresses: c.ipAddresses,
+		URIs:        c.uris,
+	}
+	if len(c.otherNames) > 0 {
+		ext, err := subjectAltNameExtension(c.dnsNames, c.ipAddresses, c.uris, c.otherNames)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to encode the subject alternative names: %s", err)
+		}
+		certificateRequestTemplate.ExtraExtensions = []pkix.Extension{ext}
+	}
+
+	certificateRequest, err := x509.CreateCertificateRequest(randReader, &certificateRequestTemplate, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate the certificate request: %s", err)
+	}
+	if len(csrAttributes) > 0 {
+		certificateRequest, err = addAttributes(certificateRequest, key, csrAttributes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to add attributes to the certificate request: %s", err)
+		}
+	}
+
+	certificateRequestBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: certificateRequest})
+
+	if c.dir != "" {
+		csrFile := path.Join(c.dir, c.csrFile)
+		if err := writeFile(csrFile, certificateRequestBytes, false); err != nil {
+			return nil, nil, fmt.Errorf("unable to %s, error: %s", csrFile, err)
+		}
+
+		log.Printf("wrote %s", csrFile)
+	}
+	return key.Public(), certificateRequestBytes, nil
+}
+
+// loadKey sets the key of c to stored, as written by an earlier run along
+// with the PEM encoded chain, so that renewals may keep it.
+func (c *certificate) loadKey(stored, chain []byte) error {
+	if c.request != nil || len(stored) == 0 {
+		return nil
+	}
+	key := decodeStoredKey(stored)
+	if keyPassphrase != "" {
+		var err error
+		if key, err = decryptKeyPEM(key, keyPassphrase); err != nil {
+			return err
+		}
+	}
+	if _, err := parseKeyPEM(key); err != nil {
+		return err
+	}
+	certs, err := parseChain(chain)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate found")
+	}
+	c.key = key
+	c.keyCreated = certs[0].NotBefore
+	return nil
+}
+
+// parseRequest parses the PEM encoded certificate request b and checks its
+// signature.
+func parseRequest(b []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+// setOutputFiles names the files derived from c requested on the command
+// line, those of a server certificate or, with client set, those of the
+// client certificate of -client-cert.
+func (c *certificate) setOutputFiles(client bool) {
+	name := func(server, other string) string {
+		if client {
+			return other
+		}
+		return server
+	}
+	if writeP7B {
+		c.p7bFile = name("chain.p7b", "client-chain.p7b")
+	}
+	if writePublicKey {
+		c.pubFile = name("tls.pub", "client.pub")
+		c.sshFile = name("tls.ssh.pub", "client.ssh.pub")
+	}
+	if writeJWKS {
+		c.jwksFile = name("jwks.json", "client-jwks.json")
+	}
+	if writeCombined {
+		// The client certificate shares the CA chain of the server's.
+		c.combinedFile = name("tls-combined.pem", "client-combined.pem")
+		c.caChainFile = name("ca-chain.pem", "")
+	}
+	if writeHAProxy {
+		c.haproxyFile = name("combined.pem", "client.pem")
+	}
+	if writeChainFiles {
+		c.chainFile = name("chain.pem", "client-chain.pem")
+		c.fullchainFile = name("fullchain.pem", "client-fullchain.pem")
+	}
+	if writeProvenance {
+		c.provenanceFile = name("tls.provenance.json", "client.provenance.json")
+	}
+	if writeVerifyConfig {
+		c.verifyFile = name("tls.verify.json", "")
+	}
+	if writePKCS12 {
+		c.p12File = name("keystore.p12", "client-keystore.p12")
+	}
+}
+
+// derive sets the outputs of c requested on the command line, pub is the
+// public key of the certificate.
+func (c *certificate) derive(iss issuer, pub crypto.PublicKey) error {
+	c.outputs = make(map[string][]byte)
+
+	// Signers may return intermediates after the leaf, which some
+	// applications want apart.
+	c.certOut = c.cert
+	if leafOnly || c.chainFile != "" || c.fullchainFile != "" {
+		leaf, intermediates, err := splitChain(c.cert)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+		}
+		if leafOnly {
+			c.certOut = leaf
+		}
+		if c.chainFile != "" {
+			c.outputs[c.chainFile] = intermediates
+		}
+		if c.fullchainFile != "" {
+			c.outputs[c.fullchainFile] = append(leaf, intermediates...)
+		}
+	}
+
+	if c.pubFile != "" {
+		b, err := marshalPublicKeyPEM(pub)
+		if err != nil {
+			return fmt.Errorf("unable to encode %s: %s", c.pubFile, err)
+		}
+		c.outputs[c.pubFile] = b
+	}
+	if c.sshFile != "" {
+		b, err := marshalAuthorizedKey(pub, c.subject.CommonName)
+		if err != nil {
+			return fmt.Errorf("unable to encode %s: %s", c.sshFile, err)
+		}
+		c.outputs[c.sshFile] = b
+	}
+
+	if c.jwksFile != "" {
+		chain, err := parseChain(c.cert)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+		}
+		c.outputs[c.jwksFile], err = marshalJWKS(chain[0])
+		if err != nil {
+			return fmt.Errorf("unable to encode %s: %s", c.jwksFile, err)
+		}
+	}
+	if c.provenanceFile != "" {
+		chain, err := parseChain(c.cert)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+		}
+		c.outputs[c.provenanceFile], err = marshalProvenance(c, chain[0])
+		if err != nil {
+			return fmt.Errorf("unable to encode %s: %s", c.provenanceFile, err)
+		}
+	}
+	if c.verifyFile != "" {
+		chain, err := parseChain(c.cert)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+		}
+		c.outputs[c.verifyFile], err = marshalVerifyConfig(c, chain[0])
+		if err != nil {
+			return fmt.Errorf("unable to encode %s: %s", c.verifyFile, err)
+		}
+	}
+	if c.combinedFile != "" {
+		c.outputs[c.combinedFile] = append(append([]byte(nil), c.atRest...), c.cert...)
+	}
+	if c.haproxyFile != "" {
+		c.outputs[c.haproxyFile] = append(append([]byte(nil), c.cert...), c.atRest...)
+	}
+	if c.caChainFile != "" {
+		chain, err := parseChain(c.cert)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+		}
+		ca, err := iss.CA()
+		if err != nil {
+			return fmt.Errorf("unable to get the CA: %s", err)
+		}
+		// The intermediates the issuer returned, then the CA.
+		var b []byte
+		for _, cert := range chain[1:] {
+			b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		c.outputs[c.caChainFile] = append(b, ca...)
+	}
+	if c.p12File != "" {
+		if c.key == nil {
+			return fmt.Errorf("unable to write %s without the private key", c.p12File)
+		}
+		chain, err := parseChain(c.cert)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+		}
+		ca, err := iss.CA()
+		if err != nil {
+			return fmt.Errorf("unable to get the CA: %s", err)
+		}
+		if roots, err := parseChain(ca); err == nil {
+			chain = append(chain, roots...)
+		}
+		// The key is found under the name of the certificate file,
+		// e.g. tls.
+		alias := strings.TrimSuffix(c.certFile, path.Ext(c.certFile))
+		c.outputs[c.p12File], err = encodePKCS12(c.key, chain, alias, keystorePassword)
+		if err != nil {
+			return fmt.Errorf("unable to encode %s: %s", c.p12File, err)
+		}
+	}
+	if c.p7bFile != "" {
+		chain, err := parseChain(c.cert)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+		}
+		ca, err := iss.CA()
+		if err != nil {
+			return fmt.Errorf("unable to get the CA: %s", err)
+		}
+		if roots, err := parseChain(ca); err == nil {
+			chain = append(chain, roots...)
+		}
+		c.outputs[c.p7bFile], err = encodePKCS7(chain)
+		if err != nil {
+			return fmt.Errorf("unable to encode %s: %s", c.p7bFile, err)
+		}
+	}
+	return nil
+}
+
+// variant returns a copy of c using a key of the given algorithm and
+// format, with suffix added to its name and file names, e.g. tls-rsa.key.
+func (c *certificate) variant(suffix, algorithm, format string) *certificate {
+	v := *c
+	v.name = c.name + "-" + suffix
+	v.keyAlgorithm, v.keyFormat = algorithm, format
+	for _, file := range []*string{&v.keyFile, &v.csrFile, &v.certFile, &v.p7bFile, &v.pubFile, &v.sshFile, &v.jwksFile, &v.combinedFile, &v.caChainFile, &v.provenanceFile, &v.verifyFile, &v.p12File, &v.chainFile, &v.fullchainFile, &v.haproxyFile} {
+		if *file != "" {
+			*file = suffixed(*file, suffix)
+		}
+	}
+	return &v
+}
+
+// suffixed returns file with suffix added to its name, before the
+// extension.
+func suffixed(file, suffix string) string {
+	if i := strings.Index(file, "."); i >= 0 {
+		return file[:i] + "-" + suffix + file[i:]
+	}
+	return file + "-" + suffix
+}
+
+// generateKey generates a private key using the given algorithm. RSA keys
+// are keysize bits long, ECDSA keys use the P-256 curve.
+func generateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "rsa":
+		return rsa.GenerateKey(randReader, keysize)
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), randReader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(randReader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key algorithm %q", algorithm)
+}
+
+// parseKeyPEM parses a PEM encoded private key in any of the formats
+// marshalPrivateKey writes.
+func parseKeyPEM(keyPEM []byte) (crypto.Signer, error) {
+	der, err := pkcs8Key(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// marshalPrivateKey encodes key in the given format, returning the PEM
+// block type along with the encoded key. PKCS#1 only holds RSA keys and
+// SEC 1 only holds ECDSA keys, PKCS#8 holds any of them.
+func marshalPrivateKey(key crypto.PrivateKey, format string) (string, []byte, error) {
+	switch format {
+	case "pkcs8":
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to convert the private key to PKCS#8: %s", err)
+		}
+		return "PRIVATE KEY", der, nil
+	case "pkcs1":
+		k, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return "", nil, fmt.Errorf("PKCS#1 only supports RSA keys, use -key-format=pkcs8")
+		}
+		return "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(k), nil
+	case "sec1":
+		k, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", nil, fmt.Errorf("SEC 1 only supports ECDSA keys, use -key-format=pkcs8")
+		}
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to convert the private key to SEC 1: %s", err)
+		}
+		return "EC PRIVATE KEY", der, nil
+	}
+	return "", nil, fmt.Errorf("unknown key format %q", format)
+}
+
+// defaultKeyFormat returns the format keys of the given algorithm are
+// written in without -key-format: PKCS#1 for RSA, unless -pkcs8 is set,
+// and PKCS#8 otherwise.
+func defaultKeyFormat(algorithm string) string {
+	if pkcs8Format || algorithm != "rsa" {
+		return "pkcs8"
+	}
+	return "pkcs1"
+}
+
+// validKeyFormat reports whether keys of the given algorithm can be
+// written in format.
+func validKeyFormat(algorithm, format string) bool {
+	switch format {
+	case "pkcs8":
+		return true
+	case "pkcs1":
+		return algorithm == "rsa"
+	case "sec1":
+		return algorithm == "ecdsa"
+	}
+	return false
+}
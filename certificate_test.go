@@ -0,0 +1,92 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+)
+
+func TestMarshalPrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": ecdsaKey, "ed25519": ed25519Key}
+
+	for algorithm, key := range keys {
+		for _, format := range []string{"pkcs8", "pkcs1", "sec1"} {
+			typ, der, err := marshalPrivateKey(key, format)
+			if valid := validKeyFormat(algorithm, format); (err == nil) != valid {
+				t.Errorf("marshalPrivateKey(%s, %s) error = %v, want valid %t", algorithm, format, err, valid)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+
+			var parsed crypto.PrivateKey
+			switch typ {
+			case "PRIVATE KEY":
+				parsed, err = x509.ParsePKCS8PrivateKey(der)
+			case "RSA PRIVATE KEY":
+				parsed, err = x509.ParsePKCS1PrivateKey(der)
+			case "EC PRIVATE KEY":
+				parsed, err = x509.ParseECPrivateKey(der)
+			default:
+				t.Errorf("marshalPrivateKey(%s, %s) returned PEM type %q", algorithm, format, typ)
+				continue
+			}
+			if err != nil {
+				t.Errorf("marshalPrivateKey(%s, %s) returned an unparsable %s: %s", algorithm, format, typ, err)
+				continue
+			}
+			if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(parsed.(crypto.Signer).Public()) {
+				t.Errorf("marshalPrivateKey(%s, %s) returned another key", algorithm, format)
+			}
+		}
+	}
+
+	if _, _, err := marshalPrivateKey(ecdsaKey, "der"); err == nil {
+		t.Error("marshalPrivateKey in an unknown format succeeded")
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	for _, algorithm := range []string{"ecdsa", "ed25519"} {
+		key, err := generateKey(algorithm)
+		if err != nil {
+			t.Errorf("generateKey(%s): %s", algorithm, err)
+			continue
+		}
+		if _, _, err := marshalPrivateKey(key, "pkcs8"); err != nil {
+			t.Errorf("generateKey(%s) returned a key that can't be stored: %s", algorithm, err)
+		}
+	}
+	if _, err := generateKey("dsa"); err == nil {
+		t.Error("generateKey of an unknown algorithm succeeded")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxIntermediates bounds the number of certificates fetched through AIA.
+const maxIntermediates = 5
+
+// parseChain parses the PEM encoded certificates in b, leaf first.
+func parseChain(b []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return chain, nil
+}
+
+// splitChain returns the leaf of the PEM encoded chain and the
+// certificates following it, PEM encoded.
+func splitChain(b []byte) (leaf, rest []byte, err error) {
+	chain, err := parseChain(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[0].Raw})
+	for _, cert := range chain[1:] {
+		rest = append(rest, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return leaf, rest, nil
+}
+
+func encodeChain(chain []*x509.Certificate) []byte {
+	var b bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return b.Bytes()
+}
+
+// completeChain follows the authority information access (caIssuers) URLs
+// of the last certificate in the PEM encoded chain until it reaches a
+// certificate issued by one in ca, or a self-signed one, then verifies the
+// assembled chain against ca. Roots are never added to the chain.
+func completeChain(certificate, ca []byte) ([]byte, error) {
+	chain, err := parseChain(certificate)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := parseChain(ca)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the CA: %s", err)
+	}
+
+	issuedByRoot := func(cert *x509.Certificate) bool {
+		for _, root := range roots {
+			if cert.CheckSignatureFrom(root) == nil {
+				return true
+			}
+		}
+		return cert.CheckSignatureFrom(cert) == nil
+	}
+
+	for fetched := 0; !issuedByRoot(chain[len(chain)-1]); fetched++ {
+		last := chain[len(chain)-1]
+		if fetched == maxIntermediates {
+			return nil, fmt.Errorf("no CA certificate found after fetching %d intermediates", fetched)
+		}
+		if len(last.IssuingCertificateURL) == 0 {
+			return nil, fmt.Errorf("the issuer of %q is missing from the chain and it has no caIssuers URL", last.Subject)
+		}
+		cert, err := fetchIssuer(last.IssuingCertificateURL[0])
+		if err != nil {
+			return nil, err
+		}
+		if err := last.CheckSignatureFrom(cert); err != nil {
+			return nil, fmt.Errorf("%s did not return the issuer of %q: %s", last.IssuingCertificateURL[0], last.Subject, err)
+		}
+		log.Printf("fetched intermediate %q from %s", cert.Subject, last.IssuingCertificateURL[0])
+		chain = append(chain, cert)
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range roots {
+		rootPool.AddCert(root)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify the assembled chain: %s", err)
+	}
+
+	// Self-signed certificates at the end of the chain are roots, which
+	// clients are expected to have already.
+	for len(chain) > 1 && chain[len(chain)-1].CheckSignatureFrom(chain[len(chain)-1]) == nil {
+		chain = chain[:len(chain)-1]
+	}
+	return encodeChain(chain), nil
+}
+
+// fetchIssuer downloads a DER or PEM encoded certificate.
+func fetchIssuer(url string) (*x509.Certificate, error) {
+	resp, err := (&http.Client{Timeout: apiTimeout}).Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download %s: %s", url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the certificate from %s: %s", url, err)
+	}
+	return cert, nil
+}
+
+// checkIssuer refuses PEM encoded chains longer than maxDepth certificates,
+// leaf included, and chains whose leaf was not issued by a pinned CA. The
+// issuing CA is looked up in the chain first, then in ca. It is pinned by
+// its SHA-256 fingerprint, with or without colons, or its subject as printed
+// by pkix.Name.String.
+func checkIssuer(certificate, ca []byte, maxDepth int, fingerprints []string, subject string) error {
+	chain, err := parseChain(certificate)
+	if err != nil {
+		return err
+	}
+	if maxDepth > 0 && len(chain) > maxDepth {
+		return fmt.Errorf("the chain holds %d certificates, more than the maximum of %d", len(chain), maxDepth)
+	}
+	if len(fingerprints) == 0 && subject == "" {
+		return nil
+	}
+
+	candidates := chain[1:]
+	if roots, err := parseChain(ca); err == nil {
+		candidates = append(candidates, roots...)
+	}
+	var issuer *x509.Certificate
+	for _, cert := range candidates {
+		if chain[0].CheckSignatureFrom(cert) == nil {
+			issuer = cert
+			break
+		}
+	}
+	if issuer == nil {
+		return fmt.Errorf("the issuer of %q is neither in the chain nor the CA", chain[0].Subject)
+	}
+
+	sum := sha256.Sum256(issuer.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	for _, f := range fingerprints {
+		if strings.EqualFold(strings.Replace(f, ":", "", -1), fingerprint) {
+			return nil
+		}
+	}
+	if subject != "" && subject == issuer.Subject.String() {
+		return nil
+	}
+	return fmt.Errorf("issued by %q (sha256 %s), which is not pinned", issuer.Subject, fingerprint)
+}
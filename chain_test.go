@@ -0,0 +1,208 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testChain returns a certificate for key valid for lifetime, signed by a
+// self-signed CA, followed by the CA.
+func testChain(t *testing.T, key crypto.Signer, lifetime time.Duration) []*x509.Certificate {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "tls-app.default.svc.cluster.local"},
+		DNSNames:     []string{"tls-app.default.svc.cluster.local"},
+		NotBefore:    now,
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*x509.Certificate{leaf, ca}
+}
+
+// testCertificate signs template with parentKey, as parent or self-signed
+// when parent is nil.
+func testCertificate(t *testing.T, template, parent *x509.Certificate, key crypto.Signer, parentKey crypto.Signer) *x509.Certificate {
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestParseChain(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain(t, key, time.Hour)
+
+	// Blocks other than certificates are skipped.
+	b := append(pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{6, 8, 42, 134, 72, 206, 61, 3, 1, 7}}), encodeChain(chain)...)
+	got, err := parseChain(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(chain) || !got[0].Equal(chain[0]) || !got[1].Equal(chain[1]) {
+		t.Errorf("parseChain returned other certificates than were encoded")
+	}
+
+	if _, err := parseChain([]byte("not a certificate")); err == nil {
+		t.Error("parseChain of no certificate succeeded")
+	}
+}
+
+func TestCompleteChain(t *testing.T) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	root := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, rootKey, rootKey)
+	intermediate := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "test intermediate"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, root, intermediateKey, rootKey)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(intermediate.Raw)
+	}))
+	defer srv.Close()
+
+	leaf := func(aia []string) *x509.Certificate {
+		return testCertificate(t, &x509.Certificate{
+			SerialNumber:          big.NewInt(3),
+			Subject:               pkix.Name{CommonName: "tls-app"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(time.Hour),
+			IssuingCertificateURL: aia,
+		}, intermediate, leafKey, intermediateKey)
+	}
+
+	withAIA := leaf([]string{srv.URL + "/intermediate.crt"})
+	got, err := completeChain(encodeChain([]*x509.Certificate{withAIA}), encodeChain([]*x509.Certificate{root}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := encodeChain([]*x509.Certificate{withAIA, intermediate}); !bytes.Equal(got, want) {
+		t.Errorf("completeChain = %q, want %q", got, want)
+	}
+
+	// A complete chain is only verified, and its root left out.
+	complete := encodeChain([]*x509.Certificate{withAIA, intermediate, root})
+	got, err = completeChain(complete, encodeChain([]*x509.Certificate{root}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := encodeChain([]*x509.Certificate{withAIA, intermediate}); !bytes.Equal(got, want) {
+		t.Errorf("completeChain of a complete chain = %q, want %q", got, want)
+	}
+
+	if _, err := completeChain(encodeChain([]*x509.Certificate{leaf(nil)}), encodeChain([]*x509.Certificate{root})); err == nil {
+		t.Error("completeChain without caIssuers URL succeeded")
+	}
+}
+
+func TestSplitChain(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain(t, key, time.Hour)
+
+	leaf, rest, err := splitChain(encodeChain(chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := encodeChain(chain[:1]); !bytes.Equal(leaf, want) {
+		t.Errorf("leaf = %q, want %q", leaf, want)
+	}
+	if want := encodeChain(chain[1:]); !bytes.Equal(rest, want) {
+		t.Errorf("rest = %q, want %q", rest, want)
+	}
+
+	if _, _, err := splitChain([]byte("not a certificate")); err == nil {
+		t.Error("splitChain of no certificate succeeded")
+	}
+}
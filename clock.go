@@ -0,0 +1,46 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "time"
+
+// A clock tells the time and waits. Everything that depends on the time
+// goes through clk, so it can be replaced, e.g. to simulate clock skew or
+// a run close to the expiry of a certificate.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+var clk clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// offsetClock runs offset ahead of the system clock, or behind it if the
+// offset is negative.
+type offsetClock struct {
+	offset time.Duration
+}
+
+func (c offsetClock) Now() time.Time                         { return time.Now().Add(c.offset) }
+func (c offsetClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (c offsetClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// since returns the time elapsed since t according to clk.
+func since(t time.Time) time.Duration {
+	return clk.Now().Sub(t)
+}
@@ -0,0 +1,294 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nocloudflare
+// +build !nocloudflare
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+)
+
+const (
+	cloudflareCertificatesURL = "https://api.cloudflare.com/client/v4/certificates"
+	cloudflareRSARootURL      = "https://developers.cloudflare.com/ssl/static/origin_ca_rsa_root.pem"
+	cloudflareECCRootURL      = "https://developers.cloudflare.com/ssl/static/origin_ca_ecc_root.pem"
+)
+
+var (
+	cloudflareTokenSecret     string
+	cloudflareTokenKey        string
+	cloudflareIngressSelector string
+	cloudflareRequestType     string
+	cloudflareValidity        int
+	cloudflareCAURL           string
+)
+
+func init() {
+	flag.StringVar(&cloudflareTokenSecret, "cloudflare-token-secret", "", "secret holding the Cloudflare API token used with -issuer=cloudflare")
+	flag.StringVar(&cloudflareTokenKey, "cloudflare-token-key", "token", "key of the Cloudflare API token in -cloudflare-token-secret")
+	flag.StringVar(&cloudflareIngressSelector, "cloudflare-ingress-selector", "", "only use hostnames of ingresses matching these labels; comma separated list of key=value")
+	flag.StringVar(&cloudflareRequestType, "cloudflare-request-type", "origin-rsa", "Cloudflare origin certificate type")
+	flag.IntVar(&cloudflareValidity, "cloudflare-validity", 5475, "requested validity of Cloudflare origin certificates in days")
+	flag.StringVar(&cloudflareCAURL, "cloudflare-ca-url", "", "where to download the Cloudflare Origin CA root from; defaults to the RSA or ECC root matching -cloudflare-request-type")
+
+	registerIssuer("cloudflare", newCloudflareIssuer)
+}
+
+// cloudflareIssuer obtains origin certificates from the Cloudflare Origin CA.
+type cloudflareIssuer struct {
+	client      *k8s.Client
+	tokenSecret string
+	tokenKey    string
+	requestType string
+	validity    int
+	caURL       string
+
+	// token is the API token last read from tokenSecret.
+	mu    sync.Mutex
+	token string
+}
+
+func newCloudflareIssuer(o *issuerOptions) (issuer, error) {
+	if cloudflareTokenSecret == "" {
+		return nil, errors.New("-issuer=cloudflare requires -cloudflare-token-secret")
+	}
+	if clientCert {
+		return nil, errors.New("the Cloudflare Origin CA does not issue client certificates")
+	}
+
+	token, err := cloudflareToken(o.client, cloudflareTokenSecret, cloudflareTokenKey, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the Cloudflare API token: %s", err)
+	}
+	caURL := cloudflareCAURL
+	if caURL == "" {
+		caURL = cloudflareRSARootURL
+		if cloudflareRequestType == "origin-ecc" {
+			caURL = cloudflareECCRootURL
+		}
+	}
+	return &cloudflareIssuer{
+		client:      o.client,
+		tokenSecret: cloudflareTokenSecret,
+		tokenKey:    cloudflareTokenKey,
+		token:       token,
+		requestType: cloudflareRequestType,
+		validity:    cloudflareValidity,
+		caURL:       caURL,
+	}, nil
+}
+
+type cloudflareRequest struct {
+	Hostnames         []string `json:"hostnames"`
+	RequestType       string   `json:"request_type"`
+	RequestedValidity int      `json:"requested_validity"`
+	CSR               string   `json:"csr"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result struct {
+		ID          string `json:"id"`
+		Certificate string `json:"certificate"`
+		ExpiresOn   string `json:"expires_on"`
+	} `json:"result"`
+}
+
+// Issue submits the certificate request to the Origin CA and returns the
+// signed certificate. The API token is read again for every request, so a
+// sidecar running with -renew picks up a rotated token.
+func (i *cloudflareIssuer) Issue(r *request) ([]byte, error) {
+	body, err := json.Marshal(cloudflareRequest{
+		Hostnames:         r.dnsNames,
+		RequestType:       i.requestType,
+		RequestedValidity: i.validity,
+		CSR:               string(r.csr),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("requesting origin certificate for %s", strings.Join(r.dnsNames, ", "))
+	token := i.currentToken()
+	resp, err := i.post(body, token)
+	// The token may have been rotated between reading and using it.
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		if t := i.currentToken(); t != token {
+			resp.Body.Close()
+			log.Println("Cloudflare API token was rejected, retrying with the rotated one")
+			resp, err = i.post(body, t)
+		}
+	}
+	if err != nil {
+		return nil, retryable(err, fmt.Errorf("unable to reach the Cloudflare API: %s", err))
+	}
+	defer resp.Body.Close()
+
+	var cr cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+		err = fmt.Errorf("unable to decode the Cloudflare API response (%s): %s", resp.Status, err)
+		if transientStatus(resp.StatusCode) {
+			err = transientError{err}
+		}
+		return nil, err
+	}
+	if !cr.Success {
+		var messages []string
+		for _, e := range cr.Errors {
+			messages = append(messages, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		err := fmt.Errorf("origin certificate request failed (%s): %s", resp.Status, strings.Join(messages, "; "))
+		if transientStatus(resp.StatusCode) {
+			err = transientError{err}
+		}
+		return nil, err
+	}
+
+	log.Printf("got origin certificate %s expiring on %s", cr.Result.ID, cr.Result.ExpiresOn)
+	return []byte(cr.Result.Certificate), nil
+}
+
+// post sends body to the certificates endpoint, authorized with token.
+func (i *cloudflareIssuer) post(body []byte, token string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", cloudflareCertificatesURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return (&http.Client{Timeout: apiTimeout}).Do(req)
+}
+
+// currentToken reads the API token from its secret again. Should that fail,
+// the token read last is used.
+func (i *cloudflareIssuer) currentToken() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	token, err := cloudflareToken(i.client, i.tokenSecret, i.tokenKey, namespace)
+	if err != nil {
+		log.Printf("unable to read the Cloudflare API token again, using the last one: %s", err)
+		return i.token
+	}
+	i.token = token
+	return token
+}
+
+// CA downloads the Origin CA root certificate.
+func (i *cloudflareIssuer) CA() ([]byte, error) {
+	resp, err := (&http.Client{Timeout: apiTimeout}).Get(i.caURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download %s: %s", i.caURL, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Hostnames returns the hosts of the ingresses in the namespace, the Origin
+// CA only signs hostnames in zones of the Cloudflare account.
+func (i *cloudflareIssuer) Hostnames() ([]string, error) {
+	return ingressHostnames(i.client, namespace, cloudflareIngressSelector)
+}
+
+// cloudflareToken reads the API token from the given key of a Secret.
+func cloudflareToken(client *k8s.Client, name, key, namespace string) (string, error) {
+	secret, err := client.CoreV1().GetSecret(context.Background(), name, namespace)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret %s: %s", name, err)
+	}
+	token, ok := secret.GetData()[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no %s key", name, key)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// ingressList holds the fields of a networking.k8s.io/v1 IngressList used
+// for hostnames, the generated client only knows extensions/v1beta1.
+type ingressList struct {
+	Items []struct {
+		Spec struct {
+			TLS []struct {
+				Hosts []string `json:"hosts"`
+			} `json:"tls"`
+			Rules []struct {
+				Host string `json:"host"`
+			} `json:"rules"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// ingressHostnames returns the hosts of every Ingress in the namespace
+// matching the selector, a comma separated list of key=value pairs.
+func ingressHostnames(client *k8s.Client, namespace, selector string) ([]string, error) {
+	var labels []string
+	for _, n := range strings.Split(selector, ",") {
+		if n == "" {
+			continue
+		}
+		s := strings.SplitN(n, "=", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid ingress selector %q", n)
+		}
+		labels = append(labels, s[0]+"="+s[1])
+	}
+
+	path := "/apis/networking.k8s.io/v1/namespaces/" + namespace + "/ingresses"
+	if len(labels) > 0 {
+		path += "?" + url.Values{"labelSelector": {strings.Join(labels, ",")}}.Encode()
+	}
+	var ingresses ingressList
+	if err := apiJSON(client, "GET", path, nil, &ingresses); err != nil {
+		return nil, err
+	}
+
+	var hostnames []string
+	seen := make(map[string]bool)
+	add := func(host string) {
+		if host == "" || seen[host] {
+			return
+		}
+		seen[host] = true
+		hostnames = append(hostnames, host)
+	}
+	for _, ingress := range ingresses.Items {
+		for _, tls := range ingress.Spec.TLS {
+			for _, host := range tls.Hosts {
+				add(host)
+			}
+		}
+		for _, rule := range ingress.Spec.Rules {
+			add(rule.Host)
+		}
+	}
+	return hostnames, nil
+}
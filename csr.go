@@ -0,0 +1,170 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// csrAttributeNames maps the names of PKCS#9 attributes accepted in
+// -csr-attributes-secret to their OIDs. Other attributes are given by OID.
+var csrAttributeNames = map[string]asn1.ObjectIdentifier{
+	"challengePassword": {1, 2, 840, 113549, 1, 9, 7},
+	"unstructuredName":  {1, 2, 840, 113549, 1, 9, 2},
+}
+
+// readCSRAttributes reads the attributes to add to certificate requests
+// from a Secret, keyed by attribute name or dotted OID.
+func readCSRAttributes(client *k8s.Client, name, namespace string) (map[string]string, error) {
+	secret, err := client.CoreV1().GetSecret(context.Background(), name, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret %s: %s", name, err)
+	}
+	attributes := make(map[string]string)
+	for k, v := range secret.GetData() {
+		if _, err := attributeOID(k); err != nil {
+			return nil, fmt.Errorf("secret %s: %s", name, err)
+		}
+		attributes[k] = strings.TrimSpace(string(v))
+	}
+	return attributes, nil
+}
+
+func attributeOID(name string) (asn1.ObjectIdentifier, error) {
+	if oid, ok := csrAttributeNames[name]; ok {
+		return oid, nil
+	}
+	oid, ok := parseOID(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown certificate request attribute %q", name)
+	}
+	return oid, nil
+}
+
+// parseOID parses a dotted OID, e.g. 1.2.840.113549.1.9.7.
+func parseOID(s string) (asn1.ObjectIdentifier, bool) {
+	var oid asn1.ObjectIdentifier
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		oid = append(oid, n)
+	}
+	return oid, len(oid) >= 2
+}
+
+// The ASN.1 structures of a PKCS#10 certificate request.
+type (
+	certificationRequest struct {
+		Info               asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+	}
+
+	certificationRequestInfo struct {
+		Version       int
+		Subject       asn1.RawValue
+		PublicKey     asn1.RawValue
+		RawAttributes []asn1.RawValue `asn1:"tag:0"`
+	}
+
+	csrAttribute struct {
+		Type   asn1.ObjectIdentifier
+		Values []asn1.RawValue `asn1:"set"`
+	}
+)
+
+// addAttributes adds string valued attributes to the DER encoded
+// certificate request der and signs it again with key. The crypto/x509
+// package only encodes the extension request attribute, while legacy CAs
+// want to see e.g. a challengePassword before issuing a certificate.
+func addAttributes(der []byte, key crypto.Signer, attributes map[string]string) ([]byte, error) {
+	parsed, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	var hash crypto.Hash
+	switch parsed.SignatureAlgorithm {
+	case x509.SHA256WithRSA, x509.ECDSAWithSHA256:
+		hash = crypto.SHA256
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	case x509.PureEd25519:
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %s", parsed.SignatureAlgorithm)
+	}
+
+	var csr certificationRequest
+	if _, err := asn1.Unmarshal(der, &csr); err != nil {
+		return nil, err
+	}
+	var info certificationRequestInfo
+	if _, err := asn1.Unmarshal(csr.Info.FullBytes, &info); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oid, err := attributeOID(name)
+		if err != nil {
+			return nil, err
+		}
+		// Printable strings are encoded as such, anything else as UTF-8.
+		value, err := asn1.Marshal(attributes[name])
+		if err != nil {
+			return nil, err
+		}
+		b, err := asn1.Marshal(csrAttribute{Type: oid, Values: []asn1.RawValue{{FullBytes: value}}})
+		if err != nil {
+			return nil, err
+		}
+		info.RawAttributes = append(info.RawAttributes, asn1.RawValue{FullBytes: b})
+	}
+
+	tbs, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	digest := tbs
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbs)
+		digest = h.Sum(nil)
+	}
+	signature, err := key.Sign(randReader, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(certificationRequest{
+		Info:               asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: csr.SignatureAlgorithm,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddAttributes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes := map[string]string{
+		"challengePassword":      "s3cret",
+		"1.3.6.1.4.1.311.13.2.1": "CertificateTemplate=WebServer",
+	}
+
+	for _, test := range []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"rsa", rsaKey},
+		{"ecdsa", ecdsaKey},
+		{"ed25519", ed25519Key},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			template := &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "tls-app"},
+				DNSNames: []string{"tls-app.default.svc.cluster.local"},
+			}
+			der, err := x509.CreateCertificateRequest(rand.Reader, template, test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			der, err = addAttributes(der, test.key, attributes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The request must still be valid and carry its names.
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := csr.CheckSignature(); err != nil {
+				t.Fatalf("invalid signature: %s", err)
+			}
+			if !reflect.DeepEqual(csr.DNSNames, template.DNSNames) {
+				t.Errorf("DNS names = %v, want %v", csr.DNSNames, template.DNSNames)
+			}
+
+			got := make(map[string]string)
+			var req certificationRequest
+			if _, err := asn1.Unmarshal(der, &req); err != nil {
+				t.Fatal(err)
+			}
+			var info certificationRequestInfo
+			if _, err := asn1.Unmarshal(req.Info.FullBytes, &info); err != nil {
+				t.Fatal(err)
+			}
+			for _, raw := range info.RawAttributes {
+				var a csrAttribute
+				if _, err := asn1.Unmarshal(raw.FullBytes, &a); err != nil {
+					t.Fatal(err)
+				}
+				var value string
+				if _, err := asn1.Unmarshal(a.Values[0].FullBytes, &value); err != nil {
+					continue // the extension request
+				}
+				got[a.Type.String()] = value
+			}
+			want := map[string]string{
+				"1.2.840.113549.1.9.7":   "s3cret",
+				"1.3.6.1.4.1.311.13.2.1": "CertificateTemplate=WebServer",
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("attributes = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAddAttributesOpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not found")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "tls-app"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = addAttributes(der, key, map[string]string{"challengePassword": "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "csr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "tls.csr")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(openssl, "req", "-in", file, "-verify", "-noout", "-text").CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl req: %s: %s", err, out)
+	}
+	if !strings.Contains(string(out), "challengePassword") || !strings.Contains(string(out), "s3cret") {
+		t.Errorf("openssl did not find the challengePassword in:\n%s", out)
+	}
+}
+
+func TestAttributeOID(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"challengePassword", "1.2.840.113549.1.9.7", true},
+		{"unstructuredName", "1.2.840.113549.1.9.2", true},
+		{"1.3.6.1.4.1.311.13.2.1", "1.3.6.1.4.1.311.13.2.1", true},
+		{"1", "", false},
+		{"1.x.3", "", false},
+		{"challenge", "", false},
+	} {
+		oid, err := attributeOID(test.name)
+		if (err == nil) != test.ok {
+			t.Errorf("attributeOID(%q) error = %v", test.name, err)
+			continue
+		}
+		if test.ok && oid.String() != test.want {
+			t.Errorf("attributeOID(%q) = %s, want %s", test.name, oid, test.want)
+		}
+	}
+}
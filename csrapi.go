@@ -0,0 +1,262 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// The generated client only speaks certificates.k8s.io/v1beta1, which was
+// removed in Kubernetes 1.22. Requests are sent as JSON instead, whose
+// shape is the same in both versions as far as this container goes.
+
+type certificateSigningRequest struct {
+	APIVersion string                          `json:"apiVersion"`
+	Kind       string                          `json:"kind"`
+	Metadata   csrMetadata                     `json:"metadata"`
+	Spec       certificateSigningRequestSpec   `json:"spec"`
+	Status     certificateSigningRequestStatus `json:"status,omitempty"`
+}
+
+type csrMetadata struct {
+	Name            string            `json:"name"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type certificateSigningRequestSpec struct {
+	Request    []byte   `json:"request"`
+	SignerName string   `json:"signerName,omitempty"`
+	Usages     []string `json:"usages,omitempty"`
+
+	// ExpirationSeconds is honored by API servers since 1.22.
+	ExpirationSeconds *int32 `json:"expirationSeconds,omitempty"`
+}
+
+type certificateSigningRequestStatus struct {
+	Conditions  []csrCondition `json:"conditions,omitempty"`
+	Certificate []byte         `json:"certificate,omitempty"`
+}
+
+type csrCondition struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// certificatesVersion is the version of the certificates API requests are
+// made in, v1 unless the cluster only serves v1beta1.
+var certificatesVersion = "v1"
+
+// A csrClient manages certificate signing requests in one version of the
+// certificates API.
+type csrClient struct {
+	client  *k8s.Client
+	version string
+}
+
+func (c *csrClient) path(name string) string {
+	p := "/apis/" + certificatesGroup + "/" + c.version + "/certificatesigningrequests"
+	if name != "" {
+		p += "/" + url.PathEscape(name)
+	}
+	return p
+}
+
+func (c *csrClient) create(csr *certificateSigningRequest) (*certificateSigningRequest, error) {
+	csr.APIVersion = certificatesGroup + "/" + c.version
+	csr.Kind = "CertificateSigningRequest"
+	created := new(certificateSigningRequest)
+	if err := apiJSON(c.client, "POST", c.path(""), csr, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *csrClient) get(name string) (*certificateSigningRequest, error) {
+	csr := new(certificateSigningRequest)
+	if err := apiJSON(c.client, "GET", c.path(name), nil, csr); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+func (c *csrClient) delete(name string) error {
+	return apiJSON(c.client, "DELETE", c.path(name), nil, nil)
+}
+
+// watch streams the requests matching selector, a label selector, calling
+// fn with each one added, changed or deleted, for at most timeout.
+func (c *csrClient) watch(selector string, timeout time.Duration, fn func(*certificateSigningRequest)) error {
+	q := url.Values{
+		"watch":          {"1"},
+		"labelSelector":  {selector},
+		"timeoutSeconds": {strconv.Itoa(int(timeout / time.Second))},
+	}
+	req, err := newAPIRequest(c.client, "GET", c.path("")+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	// The client's timeout is meant for single calls, not for watches.
+	hc := &http.Client{Transport: c.client.Client.Transport, Timeout: timeout + apiTimeout}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return apiError(resp.StatusCode, b)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			csr := new(certificateSigningRequest)
+			if err := json.Unmarshal(event.Object, csr); err != nil {
+				return err
+			}
+			fn(csr)
+		case "ERROR":
+			var status struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			return fmt.Errorf("watch failed: %s", status.Message)
+		}
+	}
+}
+
+// runLabel is set on the requests of this run, with a random value, for
+// them to be watched together.
+const runLabel = "certificate-init-container/run"
+
+// watchTimeout is how long a watch runs before it is started anew.
+const watchTimeout = 5 * time.Minute
+
+// A csrWatcher tells the requests waited on when they change, from a
+// single watch of all the requests of this run, however many there are.
+type csrWatcher struct {
+	csrs     *csrClient
+	selector string
+
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+	seen    map[string]string // resource version by name
+	running bool
+}
+
+func newCSRWatcher(csrs *csrClient, selector string) *csrWatcher {
+	return &csrWatcher{
+		csrs:     csrs,
+		selector: selector,
+		waiters:  make(map[string][]chan struct{}),
+		seen:     make(map[string]string),
+	}
+}
+
+// wait blocks until the request name changes from resourceVersion, or for
+// at most timeout, whichever comes first.
+func (w *csrWatcher) wait(name, resourceVersion string, timeout time.Duration) {
+	ch := make(chan struct{}, 1)
+	w.mu.Lock()
+	if rv, ok := w.seen[name]; ok && rv != resourceVersion {
+		w.mu.Unlock()
+		return
+	}
+	w.waiters[name] = append(w.waiters[name], ch)
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-ch:
+	case <-clk.After(timeout):
+		w.mu.Lock()
+		for i, c := range w.waiters[name] {
+			if c == ch {
+				w.waiters[name] = append(w.waiters[name][:i], w.waiters[name][i+1:]...)
+				break
+			}
+		}
+		// run stops once nobody waits.
+		if len(w.waiters[name]) == 0 {
+			delete(w.waiters, name)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// run watches the requests for as long as any of them is waited on. Should
+// watching fail, the waiters are woken to read their request themselves,
+// and the watch is started again after a while.
+func (w *csrWatcher) run() {
+	waiting := newLogThrottle()
+	for {
+		err := w.csrs.watch(w.selector, watchTimeout, func(csr *certificateSigningRequest) {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.seen[csr.Metadata.Name] = csr.Metadata.ResourceVersion
+			w.wake(csr.Metadata.Name)
+		})
+
+		w.mu.Lock()
+		if err != nil {
+			for name := range w.waiters {
+				w.wake(name)
+			}
+		}
+		if len(w.waiters) == 0 {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+
+		if err != nil {
+			waiting.Printf("unable to watch certificate signing requests, polling: %s", err)
+			clk.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// wake wakes the waiters of name, w.mu must be held.
+func (w *csrWatcher) wake(name string) {
+	for _, ch := range w.waiters[name] {
+		ch <- struct{}{}
+	}
+	delete(w.waiters, name)
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"sort"
+)
+
+// debugRequest describes a certificate request for -debug-artifacts-dir,
+// everything an approver gets to see except for the key.
+type debugRequest struct {
+	Name        string   `json:"name"`
+	Namespace   string   `json:"namespace"`
+	Issuer      string   `json:"issuer"`
+	TrustDomain string   `json:"trustDomain,omitempty"`
+	Subject     string   `json:"subject"`
+	DNSNames    []string `json:"dnsNames,omitempty"`
+	IPAddresses []string `json:"ipAddresses,omitempty"`
+	URIs        []string `json:"uris,omitempty"`
+	OtherNames  []string `json:"otherNames,omitempty"`
+	Usages      []string `json:"usages"`
+	Attributes  []string `json:"attributes,omitempty"`
+}
+
+// writeDebugArtifacts writes the certificate request csr of c to dir along
+// with a description of it, named after the request file of c. The
+// private key is never written.
+func writeDebugArtifacts(dir string, c *certificate, csr []byte) error {
+	d := debugRequest{
+		Name:        c.name,
+		Namespace:   namespace,
+		Issuer:      issuerName,
+		TrustDomain: trustDomain,
+		Subject:     c.subject.String(),
+		DNSNames:    c.dnsNames,
+		Usages:      c.usages,
+	}
+	for _, ip := range c.ipAddresses {
+		d.IPAddresses = append(d.IPAddresses, ip.String())
+	}
+	for _, u := range c.uris {
+		d.URIs = append(d.URIs, u.String())
+	}
+	for _, n := range c.otherNames {
+		d.OtherNames = append(d.OtherNames, n.String())
+	}
+	// Attribute values may be secrets, e.g. a challengePassword.
+	for name := range csrAttributes {
+		d.Attributes = append(d.Attributes, name)
+	}
+	sort.Strings(d.Attributes)
+
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{c.csrFile, csr},
+		{c.csrFile + ".json", append(b, '\n')},
+	} {
+		file := path.Join(dir, f.name)
+		if err := writeFile(file, f.data, false); err != nil {
+			return err
+		}
+		log.Printf("wrote %s", file)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// defaultableFlags are the flags a cluster-wide defaults ConfigMap may set,
+// those describing the cluster and its PKI rather than the workload.
+var defaultableFlags = map[string]bool{
+	"cluster-domain":        true,
+	"svc-domain-format":     true,
+	"pod-domain-format":     true,
+	"issuer":                true,
+	"exec-issuer":           true,
+	"exec-issuer-config":    true,
+	"signer-name":           true,
+	"probe-cluster":         true,
+	"key-algorithm":         true,
+	"key-format":            true,
+	"keysize":               true,
+	"countries":             true,
+	"organizations":         true,
+	"organizational-units":  true,
+	"fetch-intermediates":   true,
+	"max-chain-depth":       true,
+	"pin-issuer-sha256":     true,
+	"pin-issuer-subject":    true,
+	"max-accepted-duration": true,
+	"issuer-retries":        true,
+	"issuer-max-failures":   true,
+	"approval-timeout":      true,
+	"signing-timeout":       true,
+	"policy-configmap":      true,
+}
+
+// applyDefaults sets the flags not given on the command line from the
+// ConfigMap given as namespace/name, keyed by flag name. A ConfigMap that
+// doesn't exist or can't be read by the pod holds no defaults.
+func applyDefaults(client *k8s.Client, configMap string) error {
+	s := strings.SplitN(configMap, "/", 2)
+	if len(s) != 2 {
+		return fmt.Errorf("invalid configmap %q, expected namespace/name", configMap)
+	}
+	cm, err := client.CoreV1().GetConfigMap(context.Background(), s[1], s[0])
+	if apiErr, ok := err.(*k8s.APIError); ok {
+		switch apiErr.Code {
+		case http.StatusNotFound:
+			return nil
+		case http.StatusForbidden:
+			log.Printf("not allowed to read the defaults in configmap %s, using none", configMap)
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read configmap %s: %s", configMap, err)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var names []string
+	for name := range cm.GetData() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !defaultableFlags[name] {
+			return fmt.Errorf("configmap %s: %s can not be defaulted", configMap, name)
+		}
+		// Flags of issuers not compiled into this binary are skipped.
+		if set[name] || flag.Lookup(name) == nil {
+			continue
+		}
+		if err := flag.Set(name, cm.GetData()[name]); err != nil {
+			return fmt.Errorf("configmap %s: invalid value for %s: %s", configMap, name, err)
+		}
+		log.Printf("using -%s=%s from configmap %s", name, cm.GetData()[name], configMap)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	authorizationv1 "github.com/ericchiang/k8s/apis/authorization/v1"
+)
+
+// A diagnosis is what -diagnose reports: the environment as seen by the
+// container, to make sense of a container that "just hangs".
+type diagnosis struct {
+	Namespace    string                 `json:"namespace"`
+	Pod          string                 `json:"pod"`
+	Issuer       string                 `json:"issuer"`
+	Issuers      []string               `json:"issuers"`
+	Certificates []diagnosedCertificate `json:"certificates"`
+	DNS          map[string]string      `json:"dns"`
+	API          diagnosedAPI           `json:"api"`
+	Cluster      *clusterCapabilities   `json:"cluster,omitempty"`
+	Permissions  []diagnosedPermission  `json:"permissions"`
+	Secret       *diagnosedSecret       `json:"secret,omitempty"`
+	CA           diagnosedCA            `json:"ca"`
+	Flags        map[string]string      `json:"flags"`
+	Annotations  map[string]string      `json:"annotations,omitempty"`
+	Labels       map[string]string      `json:"labels,omitempty"`
+}
+
+type diagnosedCertificate struct {
+	Name        string   `json:"name"`
+	CommonName  string   `json:"commonName"`
+	DNSNames    []string `json:"dnsNames"`
+	IPAddresses []string `json:"ipAddresses"`
+	URIs        []string `json:"uris,omitempty"`
+	OtherNames  []string `json:"otherNames,omitempty"`
+	Usages      []string `json:"usages"`
+}
+
+type diagnosedAPI struct {
+	Endpoint string `json:"endpoint"`
+	Version  string `json:"version,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type diagnosedPermission struct {
+	Verb     string `json:"verb"`
+	Group    string `json:"group,omitempty"`
+	Resource string `json:"resource"`
+	Name     string `json:"name,omitempty"`
+	Allowed  bool   `json:"allowed"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type diagnosedSecret struct {
+	Name  string   `json:"name"`
+	Keys  []string `json:"keys,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+type diagnosedCA struct {
+	Subjects []string `json:"subjects,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// diagnose gathers the diagnosis for the certificates certs would request
+// from iss and writes it to w as JSON.
+func diagnose(w io.Writer, client *k8s.Client, iss issuer, certs []*certificate, labels, annotations map[string]string) error {
+	d := &diagnosis{
+		Namespace:   namespace,
+		Pod:         podName,
+		Issuer:      issuerName,
+		Issuers:     issuerNames(),
+		DNS:         make(map[string]string),
+		Flags:       make(map[string]string),
+		Labels:      labels,
+		Annotations: annotations,
+	}
+
+	for _, c := range certs {
+		dc := diagnosedCertificate{
+			Name:       c.name,
+			CommonName: c.subject.CommonName,
+			DNSNames:   c.dnsNames,
+			Usages:     c.usages,
+		}
+		for _, ip := range c.ipAddresses {
+			dc.IPAddresses = append(dc.IPAddresses, ip.String())
+		}
+		for _, u := range c.uris {
+			dc.URIs = append(dc.URIs, u.String())
+		}
+		for _, n := range c.otherNames {
+			dc.OtherNames = append(dc.OtherNames, n.String())
+		}
+		d.Certificates = append(d.Certificates, dc)
+
+		for _, n := range c.dnsNames {
+			addrs, err := net.LookupHost(n)
+			if err != nil {
+				d.DNS[n] = err.Error()
+				continue
+			}
+			sort.Strings(addrs)
+			d.DNS[n] = strings.Join(addrs, ", ")
+		}
+	}
+
+	d.API.Endpoint = client.Endpoint
+	if v, err := client.Discovery().Version(context.Background()); err != nil {
+		d.API.Error = err.Error()
+	} else {
+		d.API.Version = v.GitVersion
+	}
+
+	if caps, err := probeCluster(client); err == nil {
+		caps.Signers = listSigners(client)
+		d.Cluster = caps
+	}
+
+	for _, p := range requiredPermissions() {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: &authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:     k8s.String(p.Verb),
+					Group:    k8s.String(p.Group),
+					Resource: k8s.String(p.Resource),
+					Name:     k8s.String(p.Name),
+				},
+			},
+		}
+		if p.Group == "" {
+			review.Spec.ResourceAttributes.Namespace = k8s.String(namespace)
+		}
+		resp, err := client.AuthorizationV1().CreateSelfSubjectAccessReview(context.Background(), review)
+		if err != nil {
+			p.Reason = err.Error()
+		} else {
+			p.Allowed = resp.GetStatus().GetAllowed()
+			p.Reason = resp.GetStatus().GetReason()
+		}
+		d.Permissions = append(d.Permissions, p)
+	}
+
+	if secretName != "" {
+		d.Secret = &diagnosedSecret{Name: secretName}
+		secret, err := client.CoreV1().GetSecret(context.Background(), secretName, namespace)
+		if err != nil {
+			d.Secret.Error = err.Error()
+		} else {
+			for k := range secret.GetData() {
+				d.Secret.Keys = append(d.Secret.Keys, k)
+			}
+			sort.Strings(d.Secret.Keys)
+		}
+	}
+
+	if ca, err := iss.CA(); err != nil {
+		d.CA.Error = err.Error()
+	} else if chain, err := parseChain(ca); err != nil {
+		d.CA.Error = err.Error()
+	} else {
+		for _, cert := range chain {
+			d.CA.Subjects = append(d.CA.Subjects, cert.Subject.String())
+		}
+	}
+
+	// Only the flags that were set, the defaults are in -help.
+	flag.Visit(func(f *flag.Flag) {
+		d.Flags[f.Name] = f.Value.String()
+		if redactedFlags[f.Name] {
+			d.Flags[f.Name] = "REDACTED"
+		}
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// requiredPermissions returns the permissions the container needs with
+// the flags it was given.
+func requiredPermissions() []diagnosedPermission {
+	var perms []diagnosedPermission
+	if issuerName == "kubernetes" {
+		for _, verb := range []string{"create", "get", "watch", "delete"} {
+			perms = append(perms, diagnosedPermission{Verb: verb, Group: "certificates.k8s.io", Resource: "certificatesigningrequests"})
+		}
+	}
+	if secretName != "" {
+		for _, verb := range []string{"get", "update"} {
+			perms = append(perms, diagnosedPermission{Verb: verb, Resource: "secrets", Name: secretName})
+		}
+		// Creation can't be limited to a name.
+		if createSecret {
+			perms = append(perms, diagnosedPermission{Verb: "create", Resource: "secrets"})
+		}
+	}
+	if annotatedSvcs {
+		perms = append(perms, diagnosedPermission{Verb: "list", Resource: "services"})
+		if podInfoDir == "" {
+			perms = append(perms, diagnosedPermission{Verb: "get", Resource: "pods", Name: podName})
+		}
+	}
+	if nsLabelMapping != "" || nsAnnotationMapping != "" {
+		perms = append(perms, diagnosedPermission{Verb: "get", Resource: "namespaces", Name: namespace})
+	}
+	if podName != "" && progressInterval > 0 {
+		perms = append(perms, diagnosedPermission{Verb: "create", Resource: "events"})
+	}
+	if podName != "" && latencyAnnotations {
+		for _, verb := range []string{"get", "update"} {
+			perms = append(perms, diagnosedPermission{Verb: verb, Resource: "pods", Name: podName})
+		}
+	}
+	return perms
+}
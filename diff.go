@@ -0,0 +1,129 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// usageKeyUsages and usageExtKeyUsages map the usages of certificate
+// requests to the key usages of certificates. Usages missing here are not
+// compared.
+var (
+	usageKeyUsages = map[string]x509.KeyUsage{
+		"digital signature": x509.KeyUsageDigitalSignature,
+		"key encipherment":  x509.KeyUsageKeyEncipherment,
+		"key agreement":     x509.KeyUsageKeyAgreement,
+		"cert sign":         x509.KeyUsageCertSign,
+	}
+	usageExtKeyUsages = map[string]x509.ExtKeyUsage{
+		"server auth": x509.ExtKeyUsageServerAuth,
+		"client auth": x509.ExtKeyUsageClientAuth,
+	}
+)
+
+// A grantDiff is what a signer changed of a request: the names and usages
+// it left out or added, and the duration it chose.
+type grantDiff struct {
+	Certificate string   `json:"certificate"`
+	Missing     []string `json:"missing,omitempty"`
+	Added       []string `json:"added,omitempty"`
+	Duration    string   `json:"duration"`
+}
+
+// diffGrant compares the names and usages c requested with those of the
+// issued certificate leaf.
+func diffGrant(c *certificate, leaf *x509.Certificate) *grantDiff {
+	d := &grantDiff{
+		Certificate: c.name,
+		Duration:    leaf.NotAfter.Sub(leaf.NotBefore).String(),
+	}
+
+	var requested, granted []string
+	for _, n := range c.dnsNames {
+		requested = append(requested, "DNS:"+n)
+	}
+	for _, ip := range c.ipAddresses {
+		requested = append(requested, "IP:"+ip.String())
+	}
+	for _, u := range c.uris {
+		requested = append(requested, "URI:"+u.String())
+	}
+	for _, n := range leaf.DNSNames {
+		granted = append(granted, "DNS:"+n)
+	}
+	for _, ip := range leaf.IPAddresses {
+		granted = append(granted, "IP:"+ip.String())
+	}
+	for _, u := range leaf.URIs {
+		granted = append(granted, "URI:"+u.String())
+	}
+
+	for _, u := range c.usages {
+		if ku, ok := usageKeyUsages[u]; ok && leaf.KeyUsage&ku == 0 {
+			d.Missing = append(d.Missing, "usage:"+u)
+		}
+		if eku, ok := usageExtKeyUsages[u]; ok && !hasExtKeyUsage(leaf, eku) {
+			d.Missing = append(d.Missing, "usage:"+u)
+		}
+	}
+
+	d.Missing = append(difference(requested, granted), d.Missing...)
+	d.Added = difference(granted, requested)
+	return d
+}
+
+// names returns the missing names, leaving out usages.
+func (d *grantDiff) names() []string {
+	var names []string
+	for _, m := range d.Missing {
+		if !strings.HasPrefix(m, "usage:") {
+			names = append(names, m)
+		}
+	}
+	return names
+}
+
+func (d *grantDiff) String() string {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Sprintf("%+v", *d)
+	}
+	return string(b)
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// difference returns the elements of a missing from b.
+func difference(a, b []string) []string {
+	in := make(map[string]bool)
+	for _, s := range b {
+		in[s] = true
+	}
+	var diff []string
+	for _, s := range a {
+		if !in[s] {
+			diff = append(diff, s)
+		}
+	}
+	return diff
+}
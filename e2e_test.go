@@ -0,0 +1,463 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s/api/unversioned"
+	apiv1 "github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/runtime"
+	"github.com/golang/protobuf/proto"
+)
+
+// The end-to-end tests run the container, the test binary started anew as
+// it, against a fake API server with a signer that answers certificate
+// signing requests right away.
+
+// e2eEnv is set in the environment of the test binary to run the container
+// instead of the tests.
+const e2eEnv = "CERTIFICATE_INIT_CONTAINER_E2E"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(e2eEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// How the fake signer answers certificate signing requests.
+const (
+	signerApprove = "approve"
+	signerDeny    = "deny"
+	signerIgnore  = "ignore"
+)
+
+// fakeAPIServer serves the parts of the Kubernetes API the container uses:
+// certificate signing requests, as JSON, and secrets, as protobuf.
+type fakeAPIServer struct {
+	t      *testing.T
+	server *httptest.Server
+	signer string
+
+	// lifetime is how long the certificates signed are valid.
+	lifetime time.Duration
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+
+	mu      sync.Mutex
+	csrs    map[string]*certificateSigningRequest
+	created int
+	deleted int
+	secrets map[string]*apiv1.Secret
+}
+
+func newFakeAPIServer(t *testing.T, signer string) *fakeAPIServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake signer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeAPIServer{
+		t:        t,
+		signer:   signer,
+		lifetime: time.Hour,
+		ca:       ca,
+		caKey:    caKey,
+		csrs:     make(map[string]*certificateSigningRequest),
+		secrets:  make(map[string]*apiv1.Secret),
+	}
+	s.server = httptest.NewTLSServer(s)
+	return s
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer e2e-token" {
+		s.status(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	const (
+		csrPath    = "/apis/certificates.k8s.io/v1/certificatesigningrequests"
+		secretPath = "/api/v1/namespaces/default/secrets"
+	)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.URL.Path == csrPath && r.Method == "POST":
+		s.createCSR(w, r)
+	case strings.HasPrefix(r.URL.Path, csrPath+"/"):
+		name := strings.TrimPrefix(r.URL.Path, csrPath+"/")
+		csr, ok := s.csrs[name]
+		switch {
+		case !ok:
+			s.status(w, r, http.StatusNotFound)
+		case r.Method == "GET":
+			json.NewEncoder(w).Encode(csr)
+		case r.Method == "DELETE":
+			delete(s.csrs, name)
+			s.deleted++
+			w.Write([]byte("{}"))
+		default:
+			s.status(w, r, http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(r.URL.Path, secretPath):
+		s.serveSecret(w, r, strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, secretPath), "/"))
+	default:
+		// Watches too, the container then polls.
+		s.status(w, r, http.StatusNotFound)
+	}
+}
+
+func (s *fakeAPIServer) createCSR(w http.ResponseWriter, r *http.Request) {
+	csr := new(certificateSigningRequest)
+	if err := json.NewDecoder(r.Body).Decode(csr); err != nil {
+		s.status(w, r, http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.csrs[csr.Metadata.Name]; ok {
+		s.status(w, r, http.StatusConflict)
+		return
+	}
+	s.created++
+	csr.Metadata.UID = "uid-" + strconv.Itoa(s.created)
+	csr.Metadata.ResourceVersion = "1"
+
+	switch s.signer {
+	case signerApprove:
+		cert, err := s.sign(csr.Spec.Request)
+		if err != nil {
+			s.t.Errorf("unable to sign %s: %s", csr.Metadata.Name, err)
+			s.status(w, r, http.StatusBadRequest)
+			return
+		}
+		csr.Status.Conditions = []csrCondition{{Type: "Approved", Reason: "E2E"}}
+		csr.Status.Certificate = cert
+	case signerDeny:
+		csr.Status.Conditions = []csrCondition{{Type: "Denied", Reason: "E2E", Message: "not in the test plan"}}
+	}
+	s.csrs[csr.Metadata.Name] = csr
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(csr)
+}
+
+// sign returns a PEM encoded certificate for the PEM encoded request b,
+// issued by the fake signer's CA.
+func (s *fakeAPIServer) sign(b []byte) ([]byte, error) {
+	req, err := parseRequest(b)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      req.Subject,
+		DNSNames:     req.DNSNames,
+		IPAddresses:  req.IPAddresses,
+		NotBefore:    now,
+		NotAfter:     now.Add(s.lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, req.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func (s *fakeAPIServer) serveSecret(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case "GET":
+		secret, ok := s.secrets[name]
+		if !ok {
+			s.status(w, r, http.StatusNotFound)
+			return
+		}
+		s.writeProto(w, http.StatusOK, secret)
+	case "POST", "PUT":
+		secret := new(apiv1.Secret)
+		if err := readProto(r, secret); err != nil {
+			s.t.Errorf("unable to decode secret: %s", err)
+			s.status(w, r, http.StatusBadRequest)
+			return
+		}
+		s.secrets[secret.GetMetadata().GetName()] = secret
+		s.writeProto(w, http.StatusOK, secret)
+	default:
+		s.status(w, r, http.StatusMethodNotAllowed)
+	}
+}
+
+// status answers with the status code, in the encoding the client accepts.
+func (s *fakeAPIServer) status(w http.ResponseWriter, r *http.Request, code int) {
+	reason := http.StatusText(code)
+	status := &unversioned.Status{Status: &reason, Message: &reason, Code: proto.Int32(int32(code))}
+	if strings.Contains(r.Header.Get("Accept"), "protobuf") {
+		s.writeProto(w, code, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "Failure", "message": reason, "code": code})
+}
+
+// The protobuf encoding of the API server wraps messages in a
+// runtime.Unknown, prefixed with magic bytes.
+var protoMagic = []byte("k8s\x00")
+
+func (s *fakeAPIServer) writeProto(w http.ResponseWriter, code int, m proto.Message) {
+	raw, err := proto.Marshal(m)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	b, err := (&runtime.Unknown{Raw: raw}).Marshal()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "application/vnd.kubernetes.protobuf")
+	w.WriteHeader(code)
+	w.Write(append(append([]byte(nil), protoMagic...), b...))
+}
+
+func readProto(r *http.Request, m proto.Message) error {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	u := new(runtime.Unknown)
+	if err := u.Unmarshal(bytes.TrimPrefix(b, protoMagic)); err != nil {
+		return err
+	}
+	return proto.Unmarshal(u.Raw, m)
+}
+
+func (s *fakeAPIServer) counts() (created, deleted int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.created, s.deleted
+}
+
+// container returns the command running the container against s with args,
+// along with the directory holding its files, and its output.
+func (s *fakeAPIServer) container(args ...string) (*exec.Cmd, string, *bytes.Buffer) {
+	dir, err := ioutil.TempDir("", "e2e")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { os.RemoveAll(dir) })
+
+	token, ca := filepath.Join(dir, "token"), filepath.Join(dir, "api-ca.crt")
+	if err := ioutil.WriteFile(token, []byte("e2e-token\n"), 0600); err != nil {
+		s.t.Fatal(err)
+	}
+	apiCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, apiCA, 0600); err != nil {
+		s.t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(s.server.URL, "https://"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], append([]string{
+		"-api-token-file=" + token,
+		"-api-ca-file=" + ca,
+		"-defaults-configmap=",
+		"-signer-name=example.com/serving",
+		"-pod-ip=10.0.0.1",
+		"-namespace=default",
+	}, args...)...)
+	cmd.Env = append(os.Environ(), e2eEnv+"=1", "KUBERNETES_SERVICE_HOST="+host, "KUBERNETES_SERVICE_PORT="+port)
+	out := new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = out, out
+	return cmd, dir, out
+}
+
+// checkPair fails unless key and cert are a PEM encoded key pair issued by
+// the fake signer.
+func (s *fakeAPIServer) checkPair(key, cert []byte) {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		s.t.Fatalf("invalid key pair: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err := leaf.CheckSignatureFrom(s.ca); err != nil {
+		s.t.Errorf("certificate not issued by the fake signer: %s", err)
+	}
+	if len(leaf.IPAddresses) == 0 || !leaf.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		s.t.Errorf("certificate for %v, want the pod IP", leaf.IPAddresses)
+	}
+}
+
+func TestE2EFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the container")
+	}
+	s := newFakeAPIServer(t, signerApprove)
+	defer s.server.Close()
+
+	cmd, dir, out := s.container()
+	cmd.Args = append(cmd.Args, "-cert-dir="+dir)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	key, err := ioutil.ReadFile(filepath.Join(dir, "tls.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ioutil.ReadFile(filepath.Join(dir, "tls.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.checkPair(key, cert)
+	if created, deleted := s.counts(); created != 1 || deleted != 1 {
+		t.Errorf("%d requests created and %d deleted, want 1 and 1", created, deleted)
+	}
+}
+
+func TestE2ESecret(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the container")
+	}
+	s := newFakeAPIServer(t, signerApprove)
+	defer s.server.Close()
+	name, ns := "tls", "default"
+	s.secrets[name] = &apiv1.Secret{Metadata: &v1.ObjectMeta{Name: &name, Namespace: &ns}}
+
+	cmd, dir, out := s.container("-secret-name=tls")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	s.mu.Lock()
+	secret := s.secrets[name]
+	s.mu.Unlock()
+	data := make(map[string][]byte)
+	for k, v := range secret.GetData() {
+		data[k] = v
+	}
+	for k, v := range secret.GetStringData() {
+		data[k] = []byte(v)
+	}
+	s.checkPair(data["tls.key"], data["tls.crt"])
+	if files, _ := filepath.Glob(filepath.Join(dir, "tls.*")); len(files) > 0 {
+		t.Errorf("files written with -secret-name: %s", files)
+	}
+}
+
+func TestE2EDenied(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the container")
+	}
+	s := newFakeAPIServer(t, signerDeny)
+	defer s.server.Close()
+
+	cmd, dir, out := s.container()
+	cmd.Args = append(cmd.Args, "-cert-dir="+dir)
+	if err := cmd.Run(); err == nil {
+		t.Fatalf("denied request succeeded\n%s", out)
+	}
+	if !strings.Contains(out.String(), "was denied: E2E not in the test plan") {
+		t.Errorf("denial not reported\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tls.crt")); err == nil {
+		t.Error("certificate written for a denied request")
+	}
+}
+
+func TestE2ETimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the container")
+	}
+	s := newFakeAPIServer(t, signerIgnore)
+	defer s.server.Close()
+
+	cmd, dir, out := s.container("-approval-timeout=1s", "-progress-interval=1s")
+	cmd.Args = append(cmd.Args, "-cert-dir="+dir)
+	if err := cmd.Run(); err == nil {
+		t.Fatalf("unapproved request succeeded\n%s", out)
+	}
+	if !strings.Contains(out.String(), "was not approved within 1s") {
+		t.Errorf("timeout not reported\n%s", out)
+	}
+}
+
+func TestE2ERenewal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the container")
+	}
+	s := newFakeAPIServer(t, signerApprove)
+	defer s.server.Close()
+	s.lifetime = 30 * time.Second
+
+	cmd, dir, out := s.container("-renew", "-renew-before=28s")
+	cmd.Args = append(cmd.Args, "-cert-dir="+dir)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(20 * time.Second)
+	for created, _ := s.counts(); created < 2 && time.Now().Before(deadline); created, _ = s.counts() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	if created, _ := s.counts(); created < 2 {
+		t.Fatalf("certificates not renewed\n%s", out)
+	}
+	if !strings.Contains(out.String(), "renewing certificates") {
+		t.Errorf("renewal not reported\n%s", out)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+)
+
+// encodeStored returns PEM encoded data as written to files and secrets:
+// as is, or with -encoding=der its first block, DER holding a single key
+// or certificate.
+func encodeStored(b []byte) []byte {
+	if !derEncoding {
+		return b
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil
+	}
+	return block.Bytes
+}
+
+// decodeStoredCert returns a certificate written by encodeStored PEM
+// encoded.
+func decodeStoredCert(b []byte) []byte {
+	if !derEncoding {
+		return b
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})
+}
+
+// decodeStoredKey returns a private key written by encodeStored PEM
+// encoded, in the format it was written in.
+func decodeStoredKey(b []byte) []byte {
+	if !derEncoding {
+		return b
+	}
+	typ := "ENCRYPTED PRIVATE KEY"
+	if _, err := x509.ParsePKCS8PrivateKey(b); err == nil {
+		typ = "PRIVATE KEY"
+	} else if _, err := x509.ParsePKCS1PrivateKey(b); err == nil {
+		typ = "RSA PRIVATE KEY"
+	} else if _, err := x509.ParseECPrivateKey(b); err == nil {
+		typ = "EC PRIVATE KEY"
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})
+}
@@ -0,0 +1,40 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+const grndNonblock = 0x1
+
+// checkEntropy returns an error if the kernel's random number generator
+// is not initialized yet, as on entropy-starved nodes early in boot, when
+// generating a key would block or, with other sources, be weak.
+func checkEntropy() error {
+	b := make([]byte, 1)
+	_, _, errno := syscall.Syscall(sysGetrandom, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), grndNonblock)
+	switch errno {
+	case 0, syscall.ENOSYS:
+		// Kernels without getrandom, before 3.17, are not checked.
+		return nil
+	case syscall.EAGAIN:
+		return errors.New("the kernel random number generator is not initialized yet, the node lacks entropy; consider running haveged or rng-tools on it, or -random-source")
+	}
+	return errno
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !noexec
+// +build !noexec
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	execIssuerPath   string
+	execIssuerConfig string
+)
+
+func init() {
+	flag.StringVar(&execIssuerPath, "exec-issuer", "", "plugin program used with -issuer=exec")
+	flag.StringVar(&execIssuerConfig, "exec-issuer-config", "{}", "JSON configuration passed to the -exec-issuer plugin")
+
+	registerIssuer("exec", newExecIssuer)
+}
+
+// execIssuer delegates to a plugin program, which lets proprietary CAs be
+// integrated by adding a binary to the image. The plugin is run as
+//
+//	plugin issue	with the PEM encoded certificate request on stdin,
+//			printing the PEM encoded certificate chain
+//	plugin ca	printing the PEM encoded CA certificates
+//
+// with the request described by the JSON object in CERTIFICATE_REQUEST
+// and the -exec-issuer-config in CERTIFICATE_ISSUER_CONFIG. Whatever the
+// plugin writes to stderr is logged, a non-zero exit status fails the
+// request.
+type execIssuer struct {
+	path   string
+	config string
+}
+
+func newExecIssuer(o *issuerOptions) (issuer, error) {
+	if execIssuerPath == "" {
+		return nil, errors.New("-issuer=exec requires -exec-issuer")
+	}
+	if !json.Valid([]byte(execIssuerConfig)) {
+		return nil, errors.New("-exec-issuer-config is not valid JSON")
+	}
+	return &execIssuer{
+		path:   execIssuerPath,
+		config: execIssuerConfig,
+	}, nil
+}
+
+// execRequest describes a request to the plugin.
+type execRequest struct {
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace"`
+	DNSNames  []string `json:"dnsNames"`
+	Usages    []string `json:"usages"`
+
+	// NotBeforeBackdate is the number of seconds NotBefore should be set
+	// in the past, if any.
+	NotBeforeBackdate int64 `json:"notBeforeBackdate,omitempty"`
+
+	// DurationSeconds is how long the certificate should be valid for,
+	// if set.
+	DurationSeconds int64 `json:"durationSeconds,omitempty"`
+}
+
+// Issue runs the plugin with the certificate request.
+func (i *execIssuer) Issue(r *request) ([]byte, error) {
+	req, err := json.Marshal(execRequest{
+		Name:      r.name,
+		Namespace: namespace,
+		DNSNames:  r.dnsNames,
+		Usages:    r.usages,
+
+		NotBeforeBackdate: int64(r.backdate / time.Second),
+		DurationSeconds:   int64(r.duration / time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("requesting certificate %s from %s", r.name, i.path)
+	cert, err := i.run("issue", r.csr, string(req))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseChain(cert); err != nil {
+		return nil, fmt.Errorf("%s printed an invalid certificate chain: %s", i.path, err)
+	}
+	return cert, nil
+}
+
+// CA runs the plugin to get the CA certificates.
+func (i *execIssuer) CA() ([]byte, error) {
+	return i.run("ca", nil, "")
+}
+
+func (i *execIssuer) run(command string, stdin []byte, req string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(i.path, command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"CERTIFICATE_REQUEST="+req,
+		"CERTIFICATE_ISSUER_CONFIG="+i.config,
+	)
+	err := cmd.Run()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		log.Printf("%s %s: %s", i.path, command, redact([]byte(msg)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s", i.path, command, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// faultsEnv holds the faults to inject, for testing alerting and failure
+// handling around the container in staging. It is deliberately not a flag.
+// It is a comma separated list of:
+//
+//	deny-csr	fail every certificate request as denied
+//	drop-call=N	fail the Nth Kubernetes API call
+//	corrupt-cert	corrupt every issued certificate
+//	clock-offset=D	run with the clock D ahead, e.g. 720h or -5m
+const faultsEnv = "CERTIFICATE_INIT_CONTAINER_FAULTS"
+
+type faults struct {
+	denyCSR     bool
+	dropCall    int
+	corruptCert bool
+	clockOffset time.Duration
+}
+
+func parseFaults(s string) (*faults, error) {
+	f := &faults{}
+	for _, fault := range strings.Split(s, ",") {
+		switch {
+		case fault == "":
+		case fault == "deny-csr":
+			f.denyCSR = true
+		case fault == "corrupt-cert":
+			f.corruptCert = true
+		case strings.HasPrefix(fault, "drop-call="):
+			n, err := strconv.Atoi(strings.TrimPrefix(fault, "drop-call="))
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid fault %q", fault)
+			}
+			f.dropCall = n
+		case strings.HasPrefix(fault, "clock-offset="):
+			d, err := time.ParseDuration(strings.TrimPrefix(fault, "clock-offset="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid fault %q", fault)
+			}
+			f.clockOffset = d
+		default:
+			return nil, fmt.Errorf("unknown fault %q", fault)
+		}
+	}
+	return f, nil
+}
+
+// faultTransport fails the nth request.
+type faultTransport struct {
+	rt http.RoundTripper
+	n  int
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.calls++
+	drop := t.calls == t.n
+	t.mu.Unlock()
+	if drop {
+		log.Printf("injected fault: dropping %s %s", req.Method, req.URL)
+		return nil, errors.New("connection dropped (injected fault)")
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// faultIssuer denies requests or corrupts the certificates of the issuer
+// it wraps.
+type faultIssuer struct {
+	issuer
+	faults *faults
+}
+
+func (i *faultIssuer) Issue(r *request) ([]byte, error) {
+	if i.faults.denyCSR {
+		log.Printf("injected fault: denying %s", r.name)
+		return nil, fmt.Errorf("certificate signing request (%s) was denied (injected fault)", r.name)
+	}
+	cert, err := i.issuer.Issue(r)
+	if err != nil || !i.faults.corruptCert {
+		return cert, err
+	}
+
+	log.Printf("injected fault: corrupting the certificate of %s", r.name)
+	block, _ := pem.Decode(cert)
+	if block == nil || len(block.Bytes) == 0 {
+		return []byte("-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n"), nil
+	}
+	// Flipping a bit of the signature keeps the certificate parseable.
+	block.Bytes[len(block.Bytes)-1] ^= 1
+	return pem.EncodeToMemory(block), nil
+}
+
+// withFaults wraps iss to inject the issuer faults of f, if any.
+func withFaults(iss issuer, f *faults) issuer {
+	if !f.denyCSR && !f.corruptCert {
+		return iss
+	}
+	return &faultIssuer{issuer: iss, faults: f}
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// fetchFederatedBundles reads the CA bundles of federated clusters from
+// sources, each either configmap:namespace/name[:key], with the bundle
+// under ca.crt by default, an https URL, an http URL pinned with
+// #sha256=, e.g. the -serve-ca endpoint of another cluster, or an absolute
+// file path. A source that can't be read is replaced by its copy in
+// cacheDir, if set, or left out: one unreachable cluster must not keep
+// pods from starting.
+func fetchFederatedBundles(client *k8s.Client, sources []string, cacheDir string) []byte {
+	var bundles [][]byte
+	for _, source := range sources {
+		var cache string
+		if cacheDir != "" {
+			sum := sha256.Sum256([]byte(source))
+			cache = filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".pem")
+		}
+
+		bundle, err := fetchBundle(client, source)
+		if err == nil {
+			if cache != "" {
+				if err := writeFile(cache, bundle, false); err != nil {
+					log.Printf("unable to cache the CA bundle of %s: %s", source, err)
+				}
+			}
+			bundles = append(bundles, bundle)
+			continue
+		}
+		if cache != "" {
+			if cached, cerr := ioutil.ReadFile(cache); cerr == nil {
+				log.Printf("unable to read the CA bundle of %s, using the cached one: %s", source, err)
+				bundles = append(bundles, cached)
+				continue
+			}
+		}
+		log.Printf("unable to read the CA bundle of %s, leaving it out: %s", source, err)
+	}
+	return mergeBundles(bundles...)
+}
+
+func fetchBundle(client *k8s.Client, source string) ([]byte, error) {
+	var bundle []byte
+	switch {
+	case strings.HasPrefix(source, "configmap:"):
+		ref, key := strings.TrimPrefix(source, "configmap:"), "ca.crt"
+		if i := strings.Index(ref, ":"); i >= 0 {
+			ref, key = ref[:i], ref[i+1:]
+		}
+		s := strings.SplitN(ref, "/", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid configmap %q, expected namespace/name", ref)
+		}
+		cm, err := client.CoreV1().GetConfigMap(context.Background(), s[1], s[0])
+		if err != nil {
+			return nil, err
+		}
+		data, ok := cm.GetData()[key]
+		if !ok {
+			return nil, fmt.Errorf("configmap %s has no %s key", ref, key)
+		}
+		bundle = []byte(data)
+	case strings.HasPrefix(source, "https://"), strings.HasPrefix(source, "http://"):
+		u, pin, err := parseBundleURL(source)
+		if err != nil {
+			return nil, err
+		}
+		c := &http.Client{Timeout: apiTimeout}
+		resp, err := c.Get(u)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		bundle, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if sum := sha256.Sum256(bundle); pin != "" && hex.EncodeToString(sum[:]) != pin {
+			return nil, fmt.Errorf("the bundle has the SHA-256 %x, not the pinned %s", sum, pin)
+		}
+	case filepath.IsAbs(source):
+		var err error
+		bundle, err = ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown source, expected configmap:namespace/name, a URL or an absolute path")
+	}
+	if _, err := parseChain(bundle); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// parseBundleURL splits the SHA-256 pin of the bundle off an http(s)
+// source, if any. Plain HTTP sources must be pinned: anyone on the path
+// could otherwise add a CA of their own for the pods to trust.
+func parseBundleURL(source string) (u, pin string, err error) {
+	u = source
+	if i := strings.Index(source, "#sha256="); i >= 0 {
+		u, pin = source[:i], strings.ToLower(source[i+len("#sha256="):])
+		if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return "", "", fmt.Errorf("invalid SHA-256 pin %q", pin)
+		}
+	}
+	if strings.HasPrefix(u, "http://") && pin == "" {
+		return "", "", fmt.Errorf("%s is plain HTTP, use https or pin the bundle with #sha256=", u)
+	}
+	return u, pin, nil
+}
+
+// mergeBundles returns the certificates of the PEM bundles, each once, in
+// the order they first appear.
+func mergeBundles(bundles ...[]byte) []byte {
+	var merged []byte
+	seen := make(map[string]bool)
+	for _, b := range bundles {
+		certs, err := parseChain(b)
+		if err != nil {
+			continue
+		}
+		for _, cert := range certs {
+			if seen[string(cert.Raw)] {
+				continue
+			}
+			seen[string(cert.Raw)] = true
+			merged = append(merged, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchBundleURL(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := encodeChain(testChain(t, key, time.Hour)[1:])
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bundle)
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256(bundle)
+	pin := hex.EncodeToString(sum[:])
+
+	for _, test := range []struct {
+		name   string
+		source string
+		ok     bool
+	}{
+		{"unpinned", srv.URL + "/ca.crt", false},
+		{"pinned", srv.URL + "/ca.crt#sha256=" + pin, true},
+		{"pinned in upper case", srv.URL + "/ca.crt#sha256=" + strings.ToUpper(pin), true},
+		{"other pin", srv.URL + "/ca.crt#sha256=" + strings.Repeat("00", sha256.Size), false},
+		{"invalid pin", srv.URL + "/ca.crt#sha256=" + pin[:10], false},
+	} {
+		got, err := fetchBundle(nil, test.source)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: fetchBundle(%s) error = %v, want ok %t", test.name, test.source, err, test.ok)
+			continue
+		}
+		if test.ok && string(got) != string(bundle) {
+			t.Errorf("%s: fetchBundle(%s) = %q, want %q", test.name, test.source, got, bundle)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+)
+
+// fileName matches names that are valid both as file names and as keys
+// of a secret.
+var fileName = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// checkFileNames returns an error unless names are valid and distinct.
+func checkFileNames(names ...string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !fileName.MatchString(name) || name == "." || name == ".." {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("%s is used twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// writeFile writes data to name. With -fsgroup-compat private files are
+// only readable by the owner and the group, which is set to -fsgroup, and
+// the mode is set explicitly so neither the umask nor a previous file
+// leaves them unreadable by an application running under another UID.
+func writeFile(name string, data []byte, private bool) error {
+	if !fsGroupCompat {
+		return ioutil.WriteFile(name, data, 0644)
+	}
+
+	mode := os.FileMode(0644)
+	if private {
+		mode = 0640
+	}
+	if err := ioutil.WriteFile(name, data, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		return err
+	}
+	// Under arbitrary UIDs, as assigned by the OpenShift restricted SCC,
+	// the container may not be allowed to change the group. The volume's
+	// fsGroup then usually is the group of the file already.
+	if fsGroup >= 0 {
+		if err := os.Chown(name, -1, fsGroup); err != nil {
+			log.Printf("unable to change the group of %s to %d, leaving it as is: %s", name, fsGroup, err)
+		}
+	}
+	return nil
+}
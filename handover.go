@@ -0,0 +1,94 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/ericchiang/k8s"
+)
+
+// A handover hands the private keys and certificates over to the
+// application through a FIFO, without writing them anywhere, see
+// -handover-fifo. Each issuance is handed over once, to the first reader
+// after it.
+type handover struct {
+	fifo    string
+	bundles chan []byte
+}
+
+// newHandover creates fifo, unless it exists, and starts handing over the
+// bundles offered.
+func newHandover(fifo string) (*handover, error) {
+	if err := makeFIFO(fifo); err != nil {
+		return nil, err
+	}
+	h := &handover{fifo: fifo, bundles: make(chan []byte, 1)}
+	go h.run()
+	return h, nil
+}
+
+// offer replaces the bundle waiting to be read, if any, with b.
+func (h *handover) offer(b []byte) {
+	select {
+	case <-h.bundles:
+	default:
+	}
+	h.bundles <- b
+}
+
+// offerIssued offers the certificates of certs just issued by iss, along
+// with its CA.
+func (h *handover) offerIssued(client *k8s.Client, iss issuer, certs []*certificate) {
+	ca, err := trustedCAs(client, iss)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.offer(handoverBundle(certs, ca))
+}
+
+func (h *handover) run() {
+	for b := range h.bundles {
+		// Opening the FIFO blocks until the application opens it for
+		// reading, meanwhile the certificates may have been renewed.
+		f, err := os.OpenFile(h.fifo, os.O_WRONLY, 0)
+		if err != nil {
+			log.Fatalf("unable to open %s: %s", h.fifo, err)
+		}
+		select {
+		case b = <-h.bundles:
+		default:
+		}
+		_, err = f.Write(b)
+		f.Close()
+		if err != nil {
+			log.Printf("unable to hand over the credentials through %s: %s", h.fifo, err)
+			continue
+		}
+		log.Printf("handed over the credentials through %s", h.fifo)
+	}
+}
+
+// handoverBundle returns the PEM encoded private keys and certificates of
+// certs, each key followed by its certificate chain, and the CA.
+func handoverBundle(certs []*certificate, ca []byte) []byte {
+	var b []byte
+	for _, c := range certs {
+		if c.cert == nil {
+			continue
+		}
+		b = append(b, c.atRest...)
+		b = append(b, c.certOut...)
+	}
+	return append(b, ca...)
+}
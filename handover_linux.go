@@ -0,0 +1,40 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// makeFIFO creates the FIFO name, readable by the owner and the group, the
+// latter set to -fsgroup if given. An existing FIFO is used as is.
+func makeFIFO(name string) error {
+	fi, err := os.Stat(name)
+	if err == nil {
+		if fi.Mode()&os.ModeNamedPipe == 0 {
+			return fmt.Errorf("%s exists and is not a FIFO", name)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if err := syscall.Mkfifo(name, 0640); err != nil {
+		return err
+	}
+	if fsGroup >= 0 {
+		return os.Chown(name, -1, fsGroup)
+	}
+	return nil
+}
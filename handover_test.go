@@ -0,0 +1,70 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "tls.pem")
+
+	h, err := newHandover(fifo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fifo); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("%s is not a FIFO: %v", fifo, err)
+	}
+
+	read := func() string {
+		b, err := ioutil.ReadFile(fifo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// Only the latest bundle offered before the application reads is
+	// handed over.
+	h.offer([]byte("first"))
+	h.offer([]byte("second"))
+	if b := read(); b != "second" {
+		t.Errorf("read %q, want second", b)
+	}
+	h.offer([]byte("third"))
+	if b := read(); b != "third" {
+		t.Errorf("read %q, want third", b)
+	}
+
+	if _, err := newHandover(filepath.Join(dir, "tls.pem")); err != nil {
+		t.Errorf("existing FIFO: %s", err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newHandover(file); err == nil {
+		t.Error("regular file accepted as FIFO")
+	}
+}
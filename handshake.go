@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// handshakeTimeout bounds each handshake of testHandshake, both ends run
+// in process so anything longer means they are stuck.
+const handshakeTimeout = 10 * time.Second
+
+// testHandshake serves c's key and chain from an in-memory TLS server and
+// connects to it once for every DNS name and IP address of c, verifying the
+// server against ca as a client of the application would.
+func testHandshake(c *certificate, ca []byte) error {
+	pair, err := tls.X509KeyPair(c.cert, c.key)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates found in the CA")
+	}
+
+	names := append([]string(nil), c.dnsNames...)
+	for _, ip := range c.ipAddresses {
+		names = append(names, ip.String())
+	}
+	for _, name := range names {
+		if err := handshake(pair, roots, name); err != nil {
+			return fmt.Errorf("TLS handshake for %s failed: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func handshake(pair tls.Certificate, roots *x509.CertPool, name string) error {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	deadline := time.Now().Add(handshakeTimeout)
+	serverConn.SetDeadline(deadline)
+	clientConn.SetDeadline(deadline)
+
+	server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{pair}})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Handshake()
+	}()
+
+	client := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: name})
+	if err := client.Handshake(); err != nil {
+		// Unblock the server, which may be waiting on the client.
+		clientConn.Close()
+		<-errc
+		return err
+	}
+	return <-errc
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// A request is a certificate request to be signed by an issuer.
+type request struct {
+	// name identifies the request, e.g. as the name of the Kubernetes
+	// CertificateSigningRequest object.
+	name string
+
+	// csr is the PEM encoded certificate request.
+	csr []byte
+
+	dnsNames []string
+	usages   []string
+
+	// backdate asks the issuer to set NotBefore this far in the past, to
+	// tolerate clock skew. Issuers that can't honor it ignore it.
+	backdate time.Duration
+
+	// duration asks the issuer for certificates valid this long, if set.
+	// Issuers that can't honor it ignore it.
+	duration time.Duration
+
+	// approval is set by issuers that know who approved the request and
+	// why, for the audit log.
+	approval string
+
+	// uid is set by issuers that track the request as an object, for the
+	// audit log.
+	uid string
+
+	// approvedAfter is set by issuers that know how long the request
+	// waited for approval.
+	approvedAfter time.Duration
+}
+
+// An issuer signs certificate requests.
+type issuer interface {
+	// Issue submits a certificate request and blocks until the PEM encoded
+	// certificate has been signed.
+	Issue(r *request) ([]byte, error)
+
+	// CA returns the PEM encoded certificate authority of the issuer.
+	CA() ([]byte, error)
+}
+
+// A hostnameIssuer only signs names it is responsible for, rather than the
+// in-cluster names of the pod.
+type hostnameIssuer interface {
+	// Hostnames returns the names to request in addition to the ones given
+	// with -additional-dnsnames.
+	Hostnames() ([]string, error)
+}
+
+// issuerOptions holds what every issuer may need from main.
+type issuerOptions struct {
+	client      *k8s.Client
+	labels      map[string]string
+	annotations map[string]string
+}
+
+// issuers holds the issuers compiled into the binary by the name used with
+// -issuer. Issuers register themselves from an init function, which lets
+// build tags leave out the ones that are not needed.
+var issuers = make(map[string]func(o *issuerOptions) (issuer, error))
+
+func registerIssuer(name string, newIssuer func(o *issuerOptions) (issuer, error)) {
+	issuers[name] = newIssuer
+}
+
+func issuerNames() []string {
+	var names []string
+	for name := range issuers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// cachingIssuer remembers the CA of the issuer it wraps, which is needed
+// several times per certificate and may have to be downloaded.
+type cachingIssuer struct {
+	issuer
+
+	mu sync.Mutex
+	ca []byte
+}
+
+func withCachedCA(iss issuer) issuer {
+	return &cachingIssuer{issuer: iss}
+}
+
+// CA returns the CA of the wrapped issuer, asking it only until it
+// succeeds once.
+func (i *cachingIssuer) CA() ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.ca != nil {
+		return i.ca, nil
+	}
+	ca, err := i.issuer.CA()
+	if err != nil {
+		return nil, err
+	}
+	i.ca = ca
+	return ca, nil
+}
+
+// forget makes the next call to CA ask the wrapped issuer again, e.g.
+// after the CA was rotated.
+func (i *cachingIssuer) forget() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.ca = nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/unversioned"
+)
+
+// apiJSON sends a JSON request to the API server, for APIs and fields the
+// generated client predates. in is sent as the body unless nil, the
+// response is decoded into out unless nil. Errors are *k8s.APIError like
+// those of the generated client.
+func apiJSON(client *k8s.Client, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := newAPIRequest(client, method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return apiError(resp.StatusCode, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+func newAPIRequest(client *k8s.Client, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(client.Endpoint, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if client.SetHeaders != nil {
+		if err := client.SetHeaders(req.Header); err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// apiError returns the error of a response with status code and body b.
+func apiError(code int, b []byte) error {
+	status := new(unversioned.Status)
+	if err := json.Unmarshal(b, status); err != nil {
+		status = nil
+	}
+	return &k8s.APIError{Status: status, Code: code}
+}
@@ -0,0 +1,367 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	apiv1 "github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+// Annotations of certificate signing requests shared with signers that
+// queue requests: the priority of a request, low or high, and its position
+// in the queue, as reported by the signer.
+const (
+	priorityAnnotation      = "certificate-init-container/priority"
+	queuePositionAnnotation = "certificate-init-container/queue-position"
+)
+
+// maxWatch bounds how long a request is watched for changes before it is
+// read again, which also checks the timeouts.
+const maxWatch = 30 * time.Second
+
+// maxThrottledAttempts bounds the attempts to create a request while the
+// API server throttles them.
+const maxThrottledAttempts = 10
+
+// kubernetesIssuer obtains certificates from the Kubernetes certificates API.
+type kubernetesIssuer struct {
+	client      *k8s.Client
+	csrs        *csrClient
+	watcher     *csrWatcher
+	labels      map[string]string
+	annotations map[string]string
+
+	// signerName is the signer requests are addressed to, which v1
+	// requires; v1beta1 falls back to the legacy signer without one.
+	signerName string
+
+	// timeout bounds how long to wait for the request to be approved and
+	// signed; zero waits forever.
+	timeout time.Duration
+
+	// progressInterval is how often a pending request is reported along
+	// with the command to approve it; zero disables the reports. Reports
+	// are also recorded as events on the pod, if set.
+	progressInterval time.Duration
+	mu               sync.Mutex // guards podName in batch mode
+	podName          string
+	namespace        string
+
+	// deleteCSR deletes the request once the certificate was read, after
+	// deleteDelay, giving approvers time to finish annotating it.
+	deleteCSR   bool
+	deleteDelay time.Duration
+
+	// signingTimeout bounds how long an approved request may go without a
+	// certificate before the signer is considered to have failed.
+	signingTimeout time.Duration
+}
+
+func init() {
+	registerIssuer("kubernetes", func(o *issuerOptions) (issuer, error) {
+		id := make([]byte, 8)
+		if _, err := io.ReadFull(randReader, id); err != nil {
+			return nil, err
+		}
+		run := hex.EncodeToString(id)
+		labels := map[string]string{runLabel: run}
+		for k, v := range o.labels {
+			labels[k] = v
+		}
+		csrs := &csrClient{client: o.client, version: certificatesVersion}
+
+		return &kubernetesIssuer{
+			client:      o.client,
+			csrs:        csrs,
+			watcher:     newCSRWatcher(csrs, runLabel+"="+run),
+			labels:      labels,
+			annotations: o.annotations,
+			signerName:  signerName,
+			timeout:     approvalTimeout,
+
+			progressInterval: progressInterval,
+			podName:          podName,
+			namespace:        namespace,
+
+			deleteCSR:   deleteCSR,
+			deleteDelay: deleteCSRDelay,
+
+			signingTimeout: signingTimeout,
+		}, nil
+	})
+}
+
+// Issue submits a certificate signing request, waits for it to be approved,
+// then returns the signed certificate.
+func (i *kubernetesIssuer) Issue(r *request) ([]byte, error) {
+	certificateSigningRequest := &certificateSigningRequest{
+		Metadata: csrMetadata{
+			Name:        r.name,
+			Labels:      i.labels,
+			Annotations: i.annotations,
+		},
+		Spec: certificateSigningRequestSpec{
+			Request:    r.csr,
+			SignerName: i.signerName,
+			Usages:     r.usages,
+		},
+	}
+
+	if r.duration > 0 {
+		seconds := int32(r.duration / time.Second)
+		certificateSigningRequest.Spec.ExpirationSeconds = &seconds
+	}
+
+	// A request left over from a previous attempt can't be reused, its
+	// spec is immutable. It is only deleted when creating the new one
+	// conflicts, saving a round trip in the common case.
+	created, err := i.create(certificateSigningRequest)
+	if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusConflict {
+		log.Printf("Replacing certificate signing request %s", r.name)
+		i.csrs.delete(r.name)
+		created, err = i.create(certificateSigningRequest)
+	}
+	if err != nil {
+		return nil, retryable(err, fmt.Errorf("unable to create the certificate signing request: %s", err))
+	}
+
+	// Only the request created above is trusted to carry our certificate,
+	// not one created by someone else under the same name in the meantime.
+	uid := created.Metadata.UID
+	r.uid = uid
+	log.Printf("waiting for certificate... (uid %s)", uid)
+
+	start := clk.Now()
+	lastReport := start
+	approved := false
+	waiting := newLogThrottle()
+
+	var certificate []byte
+loop:
+	for {
+		if i.timeout > 0 && since(start) > i.timeout {
+			if approved {
+				return nil, fmt.Errorf("certificate signing request (%s) was approved but not signed within %s; "+
+					"is a controller signing certificates for this cluster (kube-controller-manager --cluster-signing-cert-file)?", r.name, i.timeout)
+			}
+			return nil, fmt.Errorf("certificate signing request (%s) was not approved within %s; "+
+				"is an approver running, or approve it with: kubectl certificate approve %s", r.name, i.timeout, r.name)
+		}
+
+		csr, err := i.csrs.get(r.name)
+		if err != nil {
+			waiting.Printf("unable to retrieve certificate signing request (%s): %s", r.name, err)
+			delay := 5 * time.Second
+			if d, ok := retryAfter(err); ok && d > delay {
+				delay = d
+			}
+			clk.Sleep(delay)
+			continue
+		}
+
+		if csr.Metadata.UID != uid {
+			return nil, fmt.Errorf("certificate signing request (%s) was replaced, its uid is %s rather than %s", r.name, csr.Metadata.UID, uid)
+		}
+
+		if i.progressInterval > 0 && since(lastReport) >= i.progressInterval {
+			i.reportProgress(csr, since(start))
+			lastReport = clk.Now()
+		}
+
+		// Signers may add conditions after approval, e.g. Failed when
+		// signing went wrong, so all of them are considered each time.
+		var approval, denial, failure *csrCondition
+		for n, c := range csr.Status.Conditions {
+			switch c.Type {
+			case "Approved":
+				approval = &csr.Status.Conditions[n]
+			case "Denied":
+				denial = &csr.Status.Conditions[n]
+			case "Failed":
+				failure = &csr.Status.Conditions[n]
+			}
+		}
+
+		switch {
+		case denial != nil:
+			return nil, fmt.Errorf("certificate signing request (%s) was denied: %s", r.name, conditionMessage(denial))
+		case failure != nil:
+			return nil, fmt.Errorf("certificate signing request (%s) was approved but signing failed: %s", r.name, conditionMessage(failure))
+		case approval != nil:
+			if !approved {
+				r.approvedAfter = since(start)
+			}
+			approved = true
+			r.approval = conditionMessage(approval)
+			certificate = csr.Status.Certificate
+			if len(certificate) > 1 {
+				// Whatever the name, a certificate for another key
+				// is of no use and must not be mistaken for ours.
+				if err := matchesRequest(certificate, r.csr); err != nil {
+					return nil, fmt.Errorf("refusing the certificate of certificate signing request (%s): %s", r.name, err)
+				}
+				log.Printf("got crt %s", certificate)
+				break loop
+			}
+			if i.signingTimeout > 0 && since(start)-r.approvedAfter > i.signingTimeout {
+				return nil, fmt.Errorf("certificate signing request (%s) was approved but not signed within %s, assuming the signer failed; "+
+					"is a controller signing certificates for this cluster (kube-controller-manager --cluster-signing-cert-file)?", r.name, i.signingTimeout)
+			}
+			waiting.Printf("certificate signing request (%s) approved, waiting for the certificate to be signed", r.name)
+		default:
+			if position := csr.Metadata.Annotations[queuePositionAnnotation]; position != "" {
+				waiting.Printf("certificate signing request (%s) not approved yet, position %s in the queue of the signer", r.name, position)
+			} else {
+				waiting.Printf("certificate signing request (%s) not approved yet", r.name)
+			}
+		}
+
+		// Rather than polling, wait for the request to change, e.g. to
+		// be approved. All requests share a watch, see csrWatcher.
+		wait := maxWatch
+		if i.progressInterval > 0 && i.progressInterval < wait {
+			wait = i.progressInterval
+		}
+		i.watcher.wait(r.name, csr.Metadata.ResourceVersion, wait)
+	}
+
+	if i.deleteCSR {
+		i.deleteRequest(r.name)
+	}
+
+	return certificate, nil
+}
+
+// deleteRequest deletes the issued certificate signing request name after
+// the grace delay. Failing to delete it only leaves it for the garbage
+// collection of the API server.
+func (i *kubernetesIssuer) deleteRequest(name string) {
+	if i.deleteDelay > 0 {
+		log.Printf("deleting certificate signing request %s in %s", name, i.deleteDelay)
+		clk.Sleep(i.deleteDelay)
+	}
+	if err := i.csrs.delete(name); err != nil {
+		log.Printf("unable to delete certificate signing request %s: %s", name, err)
+		return
+	}
+	log.Printf("Removed approved request %s", name)
+}
+
+// create creates csr, waiting as long as the API server asks to when it is
+// throttled, e.g. by the quota of a signer's admission webhook.
+func (i *kubernetesIssuer) create(csr *certificateSigningRequest) (*certificateSigningRequest, error) {
+	for attempt := 1; ; attempt++ {
+		created, err := i.csrs.create(csr)
+		delay, ok := retryAfter(err)
+		if !ok || attempt >= maxThrottledAttempts {
+			return created, err
+		}
+		log.Printf("creating certificate signing request %s was throttled, retrying in %s: %s", csr.Metadata.Name, delay, err)
+		clk.Sleep(delay)
+	}
+}
+
+// retryAfter returns how long to wait before retrying a request that
+// failed with err, if the API server throttled it. Without a Retry-After
+// of its own the request is retried after a second.
+func retryAfter(err error) (time.Duration, bool) {
+	apiErr, ok := err.(*k8s.APIError)
+	if !ok || apiErr.Code != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if seconds := apiErr.Status.GetDetails().GetRetryAfterSeconds(); seconds > 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	return time.Second, true
+}
+
+// reportProgress logs how long csr has been waiting, its conditions and how
+// an operator can approve it, and records the same as an event on the pod.
+func (i *kubernetesIssuer) reportProgress(csr *certificateSigningRequest, age time.Duration) {
+	name := csr.Metadata.Name
+
+	var conditions []string
+	for _, c := range csr.Status.Conditions {
+		condition := c.Type
+		if c.Reason != "" {
+			condition += " (" + c.Reason + ")"
+		}
+		if c.Message != "" {
+			condition += ": " + c.Message
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(conditions) == 0 {
+		conditions = []string{"Pending"}
+	}
+
+	message := fmt.Sprintf("certificate signing request %s has been waiting for %s, conditions: %s; approve it with: kubectl certificate approve %s",
+		name, age-age%time.Second, strings.Join(conditions, ", "), name)
+	log.Println(message)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.podName == "" {
+		return
+	}
+	now := clk.Now()
+	count := int32(1)
+	event := &apiv1.Event{
+		Metadata: &v1.ObjectMeta{
+			GenerateName: k8s.String(i.podName + "."),
+			Namespace:    k8s.String(i.namespace),
+		},
+		InvolvedObject: &apiv1.ObjectReference{
+			Kind:      k8s.String("Pod"),
+			Name:      k8s.String(i.podName),
+			Namespace: k8s.String(i.namespace),
+		},
+		Reason:         k8s.String("CertificatePending"),
+		Message:        k8s.String(message),
+		Source:         &apiv1.EventSource{Component: k8s.String("certificate-init-container")},
+		FirstTimestamp: metaTime(now),
+		LastTimestamp:  metaTime(now),
+		Count:          &count,
+		Type:           k8s.String("Normal"),
+	}
+	if _, err := i.client.CoreV1().CreateEvent(context.Background(), event); err != nil {
+		log.Printf("unable to record an event for pod %s, no longer trying: %s", i.podName, err)
+		i.podName = ""
+	}
+}
+
+// conditionMessage returns the reason and message of condition c.
+func conditionMessage(c *csrCondition) string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s", c.Reason, c.Message))
+}
+
+func metaTime(t time.Time) *v1.Time {
+	seconds, nanos := t.Unix(), int32(t.Nanosecond())
+	return &v1.Time{Seconds: &seconds, Nanos: &nanos}
+}
+
+// CA returns the cluster CA, by default from the pod's service account.
+func (i *kubernetesIssuer) CA() ([]byte, error) {
+	return ioutil.ReadFile(apiCAFile)
+}
@@ -13,41 +13,46 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	apiv1 "github.com/ericchiang/k8s/api/v1"
-	certificates "github.com/ericchiang/k8s/apis/certificates/v1beta1"
 
 	"github.com/ericchiang/k8s"
-	"github.com/ericchiang/k8s/apis/meta/v1"
-	"github.com/youmark/pkcs8"
 )
 
 var (
 	additionalDNSNames  string
 	certDir             string
+	fsGroupCompat       bool
+	fsGroup             int
+	atomicWrites        bool
 	clusterDomain       string
 	headlessNameAsCN    bool
 	hostname            string
 	namespace           string
 	pkcs8Format         bool
+	keyAlgorithm        string
+	keyFormat           string
+	dualKeys            bool
+	randomSource        string
 	podIP               string
 	podName             string
 	serviceIPs          string
 	serviceNames        string
+	annotatedSvcs       bool
 	subdomain           string
 	labels              string
 	secretName          string
@@ -55,102 +60,500 @@ var (
 	countries           string
 	organizations       string
 	organizationalUnits string
+	issuerName          string
+	listIssuers         bool
+	clientCert          bool
+	clientCommonName    string
+	podInfoDir          string
+	podInfoLabels       string
+	podInfoAnnotations  string
+	nsLabelMapping      string
+	nsAnnotationMapping string
+	nsLabels            map[string]string
+	nsAnnotations       map[string]string
+	verifyDNSNames      bool
+	approvalTimeout     time.Duration
+	signerName          string
+	probeAPI            bool
+	certDuration        time.Duration
+	networkTimeout      time.Duration
+	apiTokenFile        string
+	apiCAFile           string
+	renewCerts          bool
+	renewBefore         string
+	rekeyEvery          string
+	stateStore          string
+	handoverFIFO        string
+	metricsFile         string
+	proxyReadyURL       string
+	progressInterval    time.Duration
+	signingTimeout      time.Duration
+	requestPriority     string
+	verifyExisting      bool
+	debugHTTP           bool
+	debugArtifactsDir   string
+	csrInput            string
+	apiTimeout          time.Duration
+	auditLog            string
+	auditHistory        int
+	secretVersions      int
+	createSecret        bool
+	secretLabels        string
+	secretAnnotations   string
+	secretWaitTimeout   time.Duration
+	fetchIntermediates  bool
+	maxChainDepth       int
+	pinIssuers          string
+	pinIssuerSubject    string
+	pinnedIssuers       []string
+	batchConfigMap      string
+	batchConcurrency    int
+	batchInterval       time.Duration
+	issuerRetries       int
+	issuerMaxFailures   int
+	csrAttributesSecret string
+	csrAttributes       map[string]string
+	maxDuration         time.Duration
+	requireSANs         bool
+	failurePolicy       string
+	validateExec        string
+	handshakeTest       bool
+	writeP7B            bool
+	writePublicKey      bool
+	writeJWKS           bool
+	writeCombined       bool
+	writeHAProxy        bool
+	leafOnly            bool
+	writeChainFiles     bool
+	writeProvenance     bool
+	writeVerifyConfig   bool
+	outFormat           string
+	pkcs12Password      string
+	pkcs12Secret        string
+	writePKCS12         bool
+	rotatePKCS12        bool
+	outEncoding         string
+	derEncoding         bool
+	keystorePassword    string
+	keyPassphraseFile   string
+	keyPassphrase       string
+	notBeforeBackdate   time.Duration
+	logFile             string
+	deleteCSR           bool
+	deleteCSRDelay      time.Duration
+	noDNSNames          bool
+	uriSANs             string
+	trustDomain         string
+	trustBundles        string
+	federatedCAs        string
+	caOnly              bool
+	keyFileName         string
+	certFileName        string
+	caFileName          string
+	csrFileName         string
+	templateSpec        string
+	approverChecks      string
+	approverWait        time.Duration
+	outputTemplates     []outputTemplate
+	rotationCAs         string
+	rotationCheck       time.Duration
+	federationCache     string
+	otherNameSAN        string
+	commonName          string
+	sanOrder            string
+	svcDomainFormat     string
+	podDomainFormat     string
+	latencyAnnotations  bool
+	tlsHostnames        string
+	subjectFromSA       bool
+	serviceAccount      string
+	policyConfigMap     string
+	defaultsConfigMap   string
+	trustBundleFile     string
+	serveCAAddr         string
+	requestPolicy       *policy
+	diagnoseOnly        bool
 )
 
 func main() {
 	flag.StringVar(&additionalDNSNames, "additional-dnsnames", "", "additional dns names; comma separated")
 	flag.StringVar(&certDir, "cert-dir", "", "The directory where the TLS certs should be written")
+	flag.StringVar(&keyFileName, "key-file", "tls.key", "name of the private key file and secret key, e.g. server.key for Postgres")
+	flag.StringVar(&certFileName, "cert-file", "tls.crt", "name of the certificate file and secret key")
+	flag.StringVar(&caFileName, "ca-file", "ca.crt", "name of the CA in -secret-name, and of the CA file with -ca-only")
+	flag.StringVar(&approverChecks, "approver-check", "", "before requesting certificates, make sure the approver or signer is running: deployment:namespace/name with ready replicas, lease:namespace/name that is held, or an http(s) URL answering 200; comma separated")
+	flag.DurationVar(&approverWait, "approver-wait", 0, "how long to wait for -approver-check to pass; 0 fails at once")
+	flag.StringVar(&templateSpec, "template", "", "Go text/template files to render from the issued certificates into -cert-dir or -secret-name, each template=name, e.g. /etc/haproxy/ssl.tmpl=haproxy-ssl.cfg, with paths, names, fingerprints and validity; comma separated")
+	flag.StringVar(&csrFileName, "csr-out-file", "tls.csr", "name of the certificate request file; -csr-file submits a request generated elsewhere")
+	flag.BoolVar(&atomicWrites, "atomic-writes", false, "publish the files in -cert-dir all at once through symlinks and create a ready file last, for containers sharing the volume")
+	flag.BoolVar(&fsGroupCompat, "fsgroup-compat", false, "write files with explicit modes, the private key readable by the group, for restricted SCCs running the application under an arbitrary UID")
+	flag.IntVar(&fsGroup, "fsgroup", -1, "GID to give the files written with -fsgroup-compat, e.g. the pod's fsGroup; -1 keeps the default group")
 	flag.StringVar(&clusterDomain, "cluster-domain", "cluster.local", "Kubernetes cluster domain")
+	flag.StringVar(&svcDomainFormat, "svc-domain-format", "${name}.${namespace}.svc.${domain}", "template of service DNS names")
+	flag.StringVar(&podDomainFormat, "pod-domain-format", "${ip}.${namespace}.pod.${domain}", "template of pod DNS names, ${ip} has dashes instead of dots")
 	flag.BoolVar(&headlessNameAsCN, "headless-name-as-cn", false, "If a headless domain name is provided, use it as CN")
 	flag.StringVar(&hostname, "hostname", "", "hostname as defined by pod.spec.hostname")
 	flag.StringVar(&namespace, "namespace", "default", "namespace as defined by pod.metadata.namespace")
-	flag.BoolVar(&pkcs8Format, "pkcs8", false, "output secret in unencrypted PKCS#8 (java does not support PKCS#1)")
+	flag.BoolVar(&pkcs8Format, "pkcs8", false, "output secret in unencrypted PKCS#8 (java does not support PKCS#1); same as -key-format=pkcs8")
+	flag.StringVar(&keyAlgorithm, "key-algorithm", "rsa", "private key algorithm; rsa, ecdsa (P-256) or ed25519")
+	flag.StringVar(&keyFormat, "key-format", "", "private key encoding; pkcs1 (RSA only), sec1 (ECDSA only) or pkcs8, defaults to pkcs1 for RSA and pkcs8 otherwise")
+	flag.StringVar(&randomSource, "random-source", "", "device to read randomness for keys from instead of the kernel, e.g. /dev/hwrng")
+	flag.BoolVar(&dualKeys, "dual-keys", false, "issue both an RSA and an ECDSA certificate, stored as tls-rsa.* and tls-ecdsa.*, e.g. for nginx or haproxy serving both")
 	flag.StringVar(&podName, "pod-name", "", "name as defined by pod.metadata.name")
-	flag.StringVar(&podIP, "pod-ip", "", "IP address as defined by pod.status.podIP")
+	flag.StringVar(&podIP, "pod-ip", "", "IP address as defined by pod.status.podIP; not needed by issuers that only sign their own hostnames")
 	flag.StringVar(&serviceNames, "service-names", "", "service names that resolve to this Pod; comma separated")
 	flag.StringVar(&serviceIPs, "service-ips", "", "service IP addresses that resolve to this Pod; comma separated")
 	flag.StringVar(&subdomain, "subdomain", "", "subdomain as defined by pod.spec.subdomain")
+	flag.BoolVar(&annotatedSvcs, "annotated-services", false, "also include the names of the services selecting this pod that are annotated with "+includeAnnotation+"=true")
 	flag.StringVar(&labels, "labels", "", "labels to include in CertificateSigningRequest object; comma seprated list of key=value")
+	flag.StringVar(&podInfoDir, "pod-info-dir", "", "directory of a downward API volume with the pod's labels and annotations files")
+	flag.StringVar(&podInfoLabels, "pod-info-labels", "", "pod labels to copy onto the CertificateSigningRequest labels; comma separated list of from=to or a key")
+	flag.StringVar(&podInfoAnnotations, "pod-info-annotations", "", "pod annotations to copy onto the CertificateSigningRequest annotations; comma separated list of from=to or a key")
+	flag.StringVar(&nsLabelMapping, "namespace-labels", "", "labels of the pod's namespace, e.g. team or cost center, to copy onto the CertificateSigningRequest and the secret labels; comma separated list of from=to or a key")
+	flag.StringVar(&nsAnnotationMapping, "namespace-annotations", "", "annotations of the pod's namespace to copy onto the CertificateSigningRequest and the secret annotations; comma separated list of from=to or a key")
 	flag.StringVar(&secretName, "secret-name", "", "secret name to store generated files, will not be persisted to disk")
+	flag.DurationVar(&secretWaitTimeout, "secret-wait-timeout", 0, "fail if -secret-name does not exist in time; 0 waits forever")
+	flag.BoolVar(&createSecret, "create-secret", false, "create -secret-name if it does not exist instead of waiting for it, as a kubernetes.io/tls secret unless the key and certificate are stored under other names or as DER")
+	flag.StringVar(&secretLabels, "secret-labels", "", "labels of the secret created with -create-secret; comma separated list of key=value")
+	flag.StringVar(&secretAnnotations, "secret-annotations", "", "annotations of the secret created with -create-secret; comma separated list of key=value")
+	flag.IntVar(&secretVersions, "secret-versions", 0, "number of previous keys and certificates to keep in -secret-name under suffixed keys, e.g. tls.crt.1")
+	flag.BoolVar(&verifyExisting, "verify-existing-secret", false, "verify the credentials of an already populated secret and fail if they are unusable, instead of exiting")
+	flag.StringVar(&auditLog, "audit-log", "", "file to append a JSON record of each issued certificate to")
+	flag.BoolVar(&latencyAnnotations, "latency-annotations", false, "record the time to approval and issuance as annotations of the secret and the pod")
+	flag.IntVar(&auditHistory, "audit-history", 0, "number of issuance records to keep in an annotation of -secret-name; 0 disables")
+	flag.StringVar(&csrAttributesSecret, "csr-attributes-secret", "", "secret holding attributes to add to certificate requests, keyed by name (challengePassword, unstructuredName) or OID")
+	flag.BoolVar(&writeP7B, "p7b", false, "also write the certificate chain and CA as a PKCS#7 bundle, chain.p7b and client-chain.p7b")
+	flag.BoolVar(&writePublicKey, "public-key", false, "also write the public key as PEM and in OpenSSH format, tls.pub and tls.ssh.pub")
+	flag.BoolVar(&writeJWKS, "jwks", false, "also write the public key as a JWK Set, jwks.json, keyed by the certificate fingerprint")
+	flag.BoolVar(&writeCombined, "combined-pem", false, "also write the key followed by the certificate chain as tls-combined.pem and client-combined.pem, and the CA chain as ca-chain.pem")
+	flag.BoolVar(&writeHAProxy, "haproxy-pem", false, "also write the certificate chain followed by the key, as HAProxy, MongoDB and some Envoy configurations expect, as combined.pem and client.pem")
+	flag.BoolVar(&leafOnly, "leaf-only", false, "write only the leaf certificate as -cert-file, without the intermediates the signer returned after it")
+	flag.BoolVar(&writeChainFiles, "chain-files", false, "also write the intermediates the signer returned as chain.pem and the leaf followed by them as fullchain.pem, client-chain.pem and client-fullchain.pem for the client certificate")
+	flag.BoolVar(&writeProvenance, "provenance", false, "also write a JSON record of how each certificate was minted, by which version, flags, issuer and approval, as tls.provenance.json and client.provenance.json")
+	flag.BoolVar(&writeVerifyConfig, "verify-config", false, "also write tls.verify.json, telling clients in the pod the CA file, SPKI pin and names to verify the server certificate with")
+	flag.StringVar(&outFormat, "out-format", "pem", "formats to write the key and certificates in besides PEM: pkcs12 also writes keystore.p12 and client-keystore.p12 with the key, chain and CA; comma separated")
+	flag.StringVar(&outEncoding, "encoding", "pem", "encoding of the key and certificate files: pem, or der for applications that only parse DER, which holds the leaf certificate only; with der -key-file and -cert-file default to tls.der.key and tls.der.crt")
+	flag.StringVar(&pkcs12Password, "pkcs12-password", "", "password of the PKCS#12 keystores, "+pkcs12PasswordEnv+" or -pkcs12-password-secret are used if not set")
+	flag.StringVar(&pkcs12Secret, "pkcs12-password-secret", "", "name/key of a secret in the pod's namespace holding the password of the PKCS#12 keystores")
+	flag.BoolVar(&rotatePKCS12, "pkcs12-rotate-password", false, "with -renew, -secret-name and -out-format=pkcs12, protect the keystores with a new random password on every renewal, stored in the secret as "+keystorePasswordKey+" along with the one before as "+previousPasswordKey)
+	flag.StringVar(&keyPassphraseFile, "key-passphrase-file", "", "file holding a passphrase to write private keys encrypted with, as PKCS#8 ENCRYPTED PRIVATE KEY; "+keyPassphraseEnv+" is used if not set")
 	flag.IntVar(&keysize, "keysize", 2048, "bit size of private key")
+	flag.BoolVar(&noDNSNames, "no-dnsnames", false, "request no DNS names, only IP addresses and -uri-sans, e.g. for IP pinned clients")
+	flag.StringVar(&uriSANs, "uri-sans", "", "URIs to request as subject alternative names, e.g. SPIFFE IDs, with ${trustdomain} and ${namespace} replaced; comma separated")
+	flag.StringVar(&trustDomain, "trust-domain", "", "trust domain the certificates belong to, e.g. for federated meshes; SPIFFE IDs must be in it")
+	flag.StringVar(&trustBundles, "trust-bundles-configmap", "", "namespace/name of a configmap holding a CA bundle per trust domain, keyed by trust domain; the bundle of -trust-domain is used as the CA")
+	flag.StringVar(&federatedCAs, "federated-cas", "", "CA bundles of federated clusters to add to ca.crt, each configmap:namespace/name[:key], an https URL, an http URL such as another cluster's -serve-ca pinned with #sha256= and the SHA-256 of the bundle, or an absolute path; comma separated, unreachable ones are left out")
+	flag.BoolVar(&caOnly, "ca-only", false, "only write the CAs to trust, the issuer's, -rotation-cas and -federated-cas, as ca.crt, and truststore.p12 with -out-format=pkcs12, to -cert-dir or -secret-name; no key or certificate is requested")
+	flag.StringVar(&rotationCAs, "rotation-cas", "", "CA bundles to add to ca.crt while the cluster rotates its CA, ordered from the old CA to the new one, each configmap:namespace/name[:key], an https URL, an http URL pinned with #sha256= and the SHA-256 of the bundle, or an absolute path; comma separated, all are required")
+	flag.DurationVar(&rotationCheck, "rotation-check", 10*time.Minute, "with -renew and -rotation-cas, how often to check whether the certificates have to be issued anew because the CA bundles changed or are not yet signed by the new CA")
+	flag.StringVar(&federationCache, "federated-cas-cache", "", "directory to keep the last bundle read from each -federated-cas source in, used when the source is unreachable")
+	flag.StringVar(&otherNameSAN, "other-name-san", "", "otherName to request as subject alternative name, OID=value with ${namespace}, ${pod} and ${serviceaccount} replaced, e.g. 1.3.6.1.4.1.311.20.2.3=${serviceaccount}")
+	flag.StringVar(&sanOrder, "san-order", "", "order of the DNS names, and so the default CN, as names or path.Match patterns, e.g. api.example.com,*.svc.cluster.local; names matching none come last; comma separated")
+	flag.StringVar(&commonName, "common-name", "", "CN set on the certificate request, defaults to the first DNS name")
+	flag.BoolVar(&subjectFromSA, "subject-from-service-account", false, "use CN=system:serviceaccount:<namespace>:<name> and O=<namespace> unless -common-name or -organizations are set")
+	flag.StringVar(&serviceAccount, "service-account", "", "service account name as defined by pod.spec.serviceAccountName, read from the service account token if not set")
 	flag.StringVar(&countries, "countries", "", "The Cs set on the certificate request, comma separated if more than one")
 	flag.StringVar(&organizations, "organizations", "", "The Os set on the certificate request, comma separated")
 	flag.StringVar(&organizationalUnits, "organizational-units", "", "The OUs set on the certificate request, comma separated")
+	flag.BoolVar(&clientCert, "client-cert", false, "also generate a client certificate stored as client.key and client.crt")
+	flag.StringVar(&clientCommonName, "client-common-name", "", "CN of the client certificate, defaults to the CN of the server certificate")
+	flag.BoolVar(&verifyDNSNames, "verify-dnsnames", false, "warn about DNS names that do not resolve to the pod or service IP addresses")
+	flag.StringVar(&signerName, "signer-name", "kubernetes.io/kube-apiserver-client", "signer the certificate signing requests are addressed to, required by certificates.k8s.io/v1; the built-in kubernetes.io/kube-apiserver-client only signs client certificates and kubernetes.io/kubelet-serving only serving certificates, requested with matching usages, certificates for both need a custom signer, e.g. example.com/serving, and an approver for it")
+	flag.BoolVar(&probeAPI, "probe-cluster", false, "ask the API server at startup which certificates.k8s.io versions and features it serves, use v1beta1 if it lacks v1, and log what it means for the requests; without it v1 is used, served since Kubernetes 1.19")
+	flag.DurationVar(&certDuration, "cert-duration", 0, "ask the signer for certificates valid this long, at least 10m, as spec.expirationSeconds honored by Kubernetes 1.22 and later; 0 leaves it to the signer")
+	flag.BoolVar(&renewCerts, "renew", false, "run as a sidecar: instead of exiting once done, keep running and issue new certificates when -renew-before is reached")
+	flag.StringVar(&renewBefore, "renew-before", "33%", "with -renew, renew certificates this long before they expire, as a percentage of their lifetime or a duration, e.g. 33% or 24h")
+	flag.StringVar(&rekeyEvery, "rekey-every", "1", "with -renew, generate a new private key every this many renewals, e.g. 3, or once the key is older than a duration, e.g. 720h; the key is kept for the other renewals")
+	flag.StringVar(&stateStore, "renewal-state", "", "with -renew, keep when certificates were issued, are due and how many renewals failed in this file, or with secret in an annotation of -secret-name, so that a restarted sidecar neither issues anew nor forgets its backoff")
+	flag.StringVar(&handoverFIFO, "handover-fifo", "", "with -renew, write neither files nor a secret but hand the private key, certificate and CA over through this FIFO, e.g. on an emptyDir shared with the application, once per issuance to the first reader; created unless it exists")
+	flag.StringVar(&metricsFile, "metrics-file", "", "write an OpenMetrics snapshot of the run to this file, whether certificates were issued, when they expire and how long they took, e.g. for the node exporter's textfile collector")
+	flag.StringVar(&apiTokenFile, "api-token-file", defaultTokenFile, "token to authenticate to the API server with, e.g. a projected service account token with a custom audience; read again for each request")
+	flag.StringVar(&apiCAFile, "api-ca-file", defaultCAFile, "CA bundle to verify the API server with, also the CA of the kubernetes issuer")
+	flag.DurationVar(&networkTimeout, "wait-for-network", 0, "wait up to this long for the API server to be reachable, and for -proxy-ready-url to be ready, before any other call, e.g. behind a service mesh; 0 disables")
+	flag.StringVar(&proxyReadyURL, "proxy-ready-url", "", "readiness endpoint of a service mesh proxy to wait for with -wait-for-network, e.g. http://127.0.0.1:15021/healthz/ready for Istio or http://127.0.0.1:4191/ready for Linkerd")
+	flag.DurationVar(&approvalTimeout, "approval-timeout", 0, "fail if the certificate signing request is not approved and signed in time; 0 waits forever")
+	flag.StringVar(&requestPriority, "priority", "", "priority hint for signers queueing requests, low or high, set as the certificate-init-container/priority annotation")
+	flag.DurationVar(&signingTimeout, "signing-timeout", 5*time.Minute, "fail if an approved certificate signing request is not signed in time; 0 waits forever")
+	flag.DurationVar(&progressInterval, "progress-interval", time.Minute, "how often to report a pending certificate signing request and how to approve it; 0 disables")
+	flag.DurationVar(&apiTimeout, "api-timeout", 10*time.Second, "timeout of individual API calls; 0 disables")
+	flag.StringVar(&serveCAAddr, "serve-ca", "", "instead of exiting once done, keep serving the CA, and only the CA, on this address as /ca.crt, e.g. 127.0.0.1:8080; run as a sidecar")
+	flag.StringVar(&trustBundleFile, "trust-bundle-file", "", "also add the CA to this PEM trust bundle, e.g. on a hostPath volume read by node agents; the block of this issuer is replaced on each run")
+	flag.StringVar(&logFile, "log-file", "", "also append the log to this file, e.g. on a volume shared with the application")
+	flag.BoolVar(&deleteCSR, "delete-csr", true, "delete the certificate signing request once the certificate was issued")
+	flag.DurationVar(&deleteCSRDelay, "delete-csr-delay", 0, "how long to wait before deleting an issued certificate signing request, e.g. for approvers annotating it")
+	flag.StringVar(&csrInput, "csr-file", "", "submit this PEM certificate request generated elsewhere, e.g. by an HSM, instead of generating a key; its subject and names replace those of the flags")
+	flag.StringVar(&debugArtifactsDir, "debug-artifacts-dir", "", "also write the certificate requests and a description of them, but not the keys, to this directory, even with -secret-name")
+	flag.BoolVar(&debugHTTP, "debug-http", false, "log Kubernetes API requests and responses, with private keys and the bodies of secrets redacted")
+	flag.BoolVar(&fetchIntermediates, "fetch-intermediates", false, "complete the certificate chain by following caIssuers URLs and verify it")
+	flag.IntVar(&maxChainDepth, "max-chain-depth", 0, "refuse certificate chains longer than this, leaf included; 0 disables")
+	flag.StringVar(&pinIssuers, "pin-issuer-sha256", "", "refuse certificates not issued by a CA with one of these SHA-256 fingerprints; comma separated")
+	flag.StringVar(&pinIssuerSubject, "pin-issuer-subject", "", "refuse certificates not issued by a CA with this subject, e.g. CN=kubernetes")
+	flag.StringVar(&tlsHostnames, "hostnames", "", "provision -secret-name as a kubernetes.io/tls secret for these hostnames and IP addresses, e.g. for an ingress, without a pod identity; comma separated")
+	flag.StringVar(&batchConfigMap, "batch-configmap", "", "provision the secrets listed in this configmap, mapping secret names to comma separated DNS names and IP addresses, then exit")
+	flag.IntVar(&batchConcurrency, "batch-concurrency", 4, "number of certificates requested at a time with -batch-configmap")
+	flag.DurationVar(&batchInterval, "batch-interval", 0, "minimum time between two certificate requests with -batch-configmap")
+	flag.StringVar(&failurePolicy, "partial-failure-policy", partialFailureFail, "when some of several certificates can't be obtained: fail at once, continue storing the others and then fail, or best-effort storing the others and succeeding")
+	flag.BoolVar(&requireSANs, "require-sans", false, "refuse certificates lacking any of the requested DNS names, IP addresses or URIs")
+	flag.DurationVar(&maxDuration, "max-accepted-duration", 0, "refuse certificates valid for longer than this, e.g. 2160h; 0 disables")
+	flag.BoolVar(&handshakeTest, "handshake-test", false, "before writing a server certificate, complete a TLS handshake against it in memory for each of its names, verified against the CA")
+	flag.StringVar(&validateExec, "validate-exec", "", "program run with each issued certificate chain on stdin; a non-zero exit status refuses the certificate")
+	flag.DurationVar(&notBeforeBackdate, "not-before-backdate", 0, "ask the issuer to backdate NotBefore by this much to tolerate clock skew; only honored by the exec issuer")
+	flag.StringVar(&policyConfigMap, "policy-configmap", "", "namespace/name of a configmap whose policy.json restricts the names, common names, issuers and signers namespaces may use; ignored if a policy is compiled in")
+	flag.StringVar(&defaultsConfigMap, "defaults-configmap", "kube-system/cert-init-defaults", "namespace/name of a configmap holding cluster-wide defaults of flags not set on the command line, keyed by flag name; empty disables")
+	flag.StringVar(&issuerName, "issuer", "kubernetes", "where to obtain the certificate from; see -list-issuers")
+	flag.IntVar(&issuerRetries, "issuer-retries", 0, "number of times a certificate request that failed transiently, the issuer being unreachable, overloaded or failing internally, is retried, with exponential backoff; denials are not retried")
+	flag.IntVar(&issuerMaxFailures, "issuer-max-failures", 0, "stop contacting the issuer after this many consecutive transient failures; 0 disables")
+	flag.BoolVar(&diagnoseOnly, "diagnose", false, "print a report of the names, permissions, API server, secret and CA this container would use and exit")
+	flag.BoolVar(&listIssuers, "list-issuers", false, "list the issuers compiled into this binary and exit")
 	flag.Parse()
 
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("unable to open %s: %s", logFile, err)
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, f))
+	}
+
+	if listIssuers {
+		for _, name := range issuerNames() {
+			fmt.Println(name)
+		}
+		os.Exit(0)
+	}
+
 	certificateSigningRequestName := fmt.Sprintf("%s-%s", podName, namespace)
 
-	client, err := k8s.NewInClusterClient()
+	client, err := newAPIClient(apiTokenFile, apiCAFile)
 	if err != nil {
 		log.Fatalf("unable to create a Kubernetes client: %s", err)
 	}
+	// The client doesn't pass contexts on to its requests, so API calls
+	// are bounded by the timeout of the underlying HTTP client instead.
+	client.Client.Timeout = apiTimeout
+	if debugHTTP {
+		client.Client.Transport = &debugTransport{client.Client.Transport}
+	}
+	injected, err := parseFaults(os.Getenv(faultsEnv))
+	if err != nil {
+		log.Fatalf("invalid %s: %s", faultsEnv, err)
+	}
+	if injected.clockOffset != 0 {
+		clk = offsetClock{injected.clockOffset}
+	}
+	if injected.dropCall > 0 {
+		client.Client.Transport = &faultTransport{rt: client.Client.Transport, n: injected.dropCall}
+	}
+
+	// A mesh may capture the traffic of init containers before its proxy
+	// runs, leaving every API call hanging.
+	if networkTimeout > 0 {
+		if err := waitForNetwork(client, proxyReadyURL, networkTimeout); err != nil {
+			log.Fatal(err)
+		}
+	} else if proxyReadyURL != "" {
+		log.Fatal("-proxy-ready-url requires -wait-for-network")
+	}
+
+	// Platform-wide settings come from the cluster, flags of the pod win.
+	if defaultsConfigMap != "" {
+		if err := applyDefaults(client, defaultsConfigMap); err != nil {
+			log.Fatalf("unable to apply the cluster-wide defaults: %s", err)
+		}
+	}
 
 	if certDir != "" && secretName != "" {
 		log.Fatal("-cert-dir and -secret-name does not make sense together")
 	}
+	// The key is only ever held in memory, which takes a running sidecar.
+	if handoverFIFO != "" && (certDir != "" || secretName != "" || !renewCerts) {
+		log.Fatal("-handover-fifo requires -renew and can not be used with -cert-dir or -secret-name")
+	}
 
 	if certDir == "" {
 		certDir = "/etc/tls"
 	}
 
-	// Before we do anything, if we are storing in a secret, make sure it doesn't contain TLS data already.
-	var secret *apiv1.Secret
-	if secretName != "" {
-		for {
-			ks, err := client.CoreV1().GetSecret(context.Background(), secretName, namespace)
-			if err != nil {
-				log.Printf("Secret to store credentials (%s) not found; trying again in 5 seconds", secretName)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			secretData := ks.GetData()
-			for _, file := range [...]string{"tls.key", "tls.crt", "ca.crt"} {
-				if _, present := secretData[file]; !present {
-					log.Printf("Missing file %s... continuing to generate keys and certificates", file)
-					secret = ks
-					break
+	switch outEncoding {
+	case "pem":
+	case "der":
+		derEncoding = true
+		if tlsHostnames != "" || batchConfigMap != "" {
+			log.Fatal("-encoding=der can not be used with -hostnames or -batch-configmap, which provision kubernetes.io/tls secrets")
+		}
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+		if !set["key-file"] {
+			keyFileName = "tls.der.key"
+		}
+		if !set["cert-file"] {
+			certFileName = "tls.der.crt"
+		}
+	default:
+		log.Fatalf("invalid -encoding %q, expected pem or der", outEncoding)
+	}
+
+	if err := checkFileNames(keyFileName, certFileName, caFileName, csrFileName); err != nil {
+		log.Fatalf("invalid -key-file, -cert-file, -ca-file or -csr-out-file: %s", err)
+	}
+
+	// Templates are read up front, a typo is better found before
+	// requesting certificates.
+	outputTemplates, err = parseOutputTemplates(templateSpec)
+	if err != nil {
+		log.Fatalf("unable to read -template: %s", err)
+	}
+
+	switch failurePolicy {
+	case partialFailureFail, partialFailureContinue, partialFailureBestEffort:
+	default:
+		log.Fatalf("invalid -partial-failure-policy %q, expected fail, continue or best-effort", failurePolicy)
+	}
+
+	if fsGroup >= 0 && !fsGroupCompat {
+		log.Fatal("-fsgroup requires -fsgroup-compat")
+	}
+
+	renewal, err := parseRenewalPolicy(renewBefore)
+	if err != nil {
+		log.Fatalf("invalid -renew-before: %s", err)
+	}
+	rekey, err := parseRekeyPolicy(rekeyEvery)
+	if err != nil {
+		log.Fatalf("invalid -rekey-every: %s", err)
+	}
+	if renewCerts && (tlsHostnames != "" || batchConfigMap != "") {
+		log.Fatal("-renew does not support -hostnames and -batch-configmap")
+	}
+	if stateStore != "" && (!renewCerts || stateStore == "secret" && secretName == "") {
+		log.Fatal("-renewal-state requires -renew, and -secret-name to keep it in the secret")
+	}
+
+	// The API server refuses shorter durations.
+	if certDuration != 0 && certDuration < 10*time.Minute {
+		log.Fatalf("invalid -cert-duration %s, the minimum is 10m", certDuration)
+	}
+
+	if usages, ok := builtinSignerUsages[signerName]; ok && issuerName == "kubernetes" && clientCert {
+		log.Fatalf("-client-cert requests a server and a client certificate, %s only signs %s certificates", signerName, usages[len(usages)-1])
+	}
+
+	if caOnly && (csrInput != "" || clientCert || tlsHostnames != "" || batchConfigMap != "" || renewCerts) {
+		log.Fatal("-ca-only can not be used with -csr-file, -client-cert, -hostnames, -batch-configmap or -renew")
+	}
+	if rotationCAs != "" && rotationCheck <= 0 {
+		log.Fatalf("invalid -rotation-check %s", rotationCheck)
+	}
+	for name, sources := range map[string]string{"federated-cas": federatedCAs, "rotation-cas": rotationCAs} {
+		for _, s := range strings.Split(sources, ",") {
+			if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+				if _, _, err := parseBundleURL(s); err != nil {
+					log.Fatalf("invalid -%s: %s", name, err)
 				}
 			}
-			if secret != nil {
-				break
-			}
-			log.Println("Secret is present and contains data, will exit.")
-			os.Exit(0)
 		}
 	}
-	// Generate a private key, pem encode it, and save it to the filesystem.
-	// The private key will be used to create a certificate signing request (csr)
-	// that will be submitted to a Kubernetes CA to obtain a TLS certificate.
-	key, err := rsa.GenerateKey(rand.Reader, keysize)
+
+	for _, f := range strings.Split(outFormat, ",") {
+		switch f {
+		case "pem":
+		case "pkcs12":
+			writePKCS12 = true
+		default:
+			log.Fatalf("invalid -out-format %q, expected pem or pkcs12", f)
+		}
+	}
+	if rotatePKCS12 && (!renewCerts || secretName == "" || !writePKCS12) {
+		log.Fatal("-pkcs12-rotate-password requires -renew, -secret-name and -out-format=pkcs12")
+	}
+	// A rotated password is random from the start, unless one is given.
+	if writePKCS12 && rotatePKCS12 && pkcs12Password == "" && os.Getenv(pkcs12PasswordEnv) == "" && pkcs12Secret == "" {
+		if err := rotateKeystorePassword(); err != nil {
+			log.Fatalf("unable to generate the keystore password: %s", err)
+		}
+	} else if writePKCS12 {
+		keystorePassword, err = readKeystorePassword(client, pkcs12Password, pkcs12Secret, namespace)
+		if err != nil {
+			log.Fatalf("unable to get the keystore password: %s", err)
+		}
+	}
+
+	keyPassphrase, err = readKeyPassphrase(keyPassphraseFile)
 	if err != nil {
-		log.Fatalf("unable to genarate the private key: %s", err)
+		log.Fatalf("unable to read the key passphrase: %s", err)
 	}
 
-	var ptype string
-	var pkey []byte
-	if pkcs8Format {
-		ptype = "PRIVATE KEY"
-		pkey, err = pkcs8.ConvertPrivateKeyToPKCS8(key)
+	// Without a key only the certificate of the given request is stored.
+	var pregenerated []byte
+	if csrInput != "" {
+		if clientCert || tlsHostnames != "" || batchConfigMap != "" || writeCombined || writeHAProxy || writePKCS12 {
+			log.Fatal("-csr-file can not be used with -client-cert, -hostnames, -batch-configmap, -combined-pem, -haproxy-pem or -out-format=pkcs12")
+		}
+		pregenerated, err = ioutil.ReadFile(csrInput)
 		if err != nil {
-			panic(err)
+			log.Fatalf("unable to read %s: %s", csrInput, err)
+		}
+		if _, err := parseRequest(pregenerated); err != nil {
+			log.Fatalf("invalid certificate request %s: %s", csrInput, err)
 		}
-	} else {
-		ptype = "RSA PRIVATE KEY"
-		pkey = x509.MarshalPKCS1PrivateKey(key)
 	}
 
-	pemKeyBytes := pem.EncodeToMemory(&pem.Block{
-		Type:  ptype,
-		Bytes: pkey,
-	})
+	// Dual keys take the default format of each algorithm, unless a
+	// format all of them support is given.
+	if dualKeys {
+		if csrInput != "" {
+			log.Fatal("-dual-keys can not be used with -csr-file")
+		}
+		if keyFormat != "" && keyFormat != "pkcs8" {
+			log.Fatalf("-dual-keys can not write both RSA and ECDSA keys as %q", keyFormat)
+		}
+	}
+	// Keys are only as good as the randomness they are made of.
+	if randomSource != "" {
+		if err := openRandomSource(randomSource); err != nil {
+			log.Fatalf("unable to use the random source: %s", err)
+		}
+	} else if err := checkEntropy(); err != nil {
+		log.Fatal(err)
+	}
+
+	keyFormatSet := keyFormat != ""
+	if keyFormat == "" {
+		keyFormat = defaultKeyFormat(keyAlgorithm)
+	}
+	switch keyAlgorithm {
+	case "rsa", "ecdsa", "ed25519":
+	default:
+		log.Fatalf("unknown key algorithm %q", keyAlgorithm)
+	}
+	if !validKeyFormat(keyAlgorithm, keyFormat) {
+		log.Fatalf("%s keys can not be written as %q", keyAlgorithm, keyFormat)
+	}
 
-	if secretName == "" {
-		keyFile := path.Join(certDir, "tls.key")
-		if err := ioutil.WriteFile(keyFile, pemKeyBytes, 0644); err != nil {
-			log.Fatalf("unable to write to %s: %s", keyFile, err)
+	for _, f := range strings.Split(pinIssuers, ",") {
+		if f != "" {
+			pinnedIssuers = append(pinnedIssuers, f)
 		}
+	}
 
-		log.Printf("wrote %s", keyFile)
+	switch {
+	case compiledPolicy != "":
+		requestPolicy, err = parsePolicy(compiledPolicy)
+		if err != nil {
+			log.Fatalf("invalid compiled in policy: %s", err)
+		}
+	case policyConfigMap != "":
+		requestPolicy, err = readPolicy(client, policyConfigMap)
+		if err != nil {
+			log.Fatalf("unable to read the policy: %s", err)
+		}
+	}
+
+	newIssuer, ok := issuers[issuerName]
+	if !ok {
+		log.Fatalf("unknown issuer %q, this binary supports: %s", issuerName, strings.Join(issuerNames(), ", "))
 	}
 
 	// Gather the list of labels that will be added to the CreateCertificateSigningRequest object
@@ -168,17 +571,243 @@ func main() {
 		labelsMap[label] = key
 	}
 
+	// Labels and annotations can also be taken from the pod's own metadata,
+	// as projected by a downward API volume, without read access to pods.
+	annotationsMap := make(map[string]string)
+	if podInfoDir != "" {
+		podLabels, err := readPodInfo(podInfoDir, "labels")
+		if err != nil {
+			log.Fatalf("unable to read pod labels: %s", err)
+		}
+		mapPodInfo(labelsMap, podLabels, podInfoLabels)
+
+		podAnnotations, err := readPodInfo(podInfoDir, "annotations")
+		if err != nil {
+			log.Fatalf("unable to read pod annotations: %s", err)
+		}
+		mapPodInfo(annotationsMap, podAnnotations, podInfoAnnotations)
+	}
+
+	// Ownership recorded on the namespace follows its certificates, e.g.
+	// for governance reporting.
+	if nsLabelMapping != "" || nsAnnotationMapping != "" {
+		labels, annotations, err := readNamespaceMetadata(client, namespace)
+		if err != nil {
+			log.Fatalf("unable to read namespace %s: %s", namespace, err)
+		}
+		nsLabels, nsAnnotations = make(map[string]string), make(map[string]string)
+		mapPodInfo(nsLabels, labels, nsLabelMapping)
+		mapPodInfo(nsAnnotations, annotations, nsAnnotationMapping)
+		for k, v := range nsLabels {
+			labelsMap[k] = v
+		}
+		for k, v := range nsAnnotations {
+			annotationsMap[k] = v
+		}
+	}
+
+	var trustDomainCA []byte
+	if trustDomain != "" {
+		labelsMap[trustDomainLabel] = trustDomain
+		if trustBundles != "" {
+			trustDomainCA, err = readTrustBundle(client, trustBundles, trustDomain)
+			if err != nil {
+				log.Fatalf("unable to read the trust bundle: %s", err)
+			}
+		}
+	} else if trustBundles != "" {
+		log.Fatal("-trust-bundles-configmap requires -trust-domain")
+	}
+
+	// Signers enforcing quotas may serve interactive deployments before
+	// batch rollouts.
+	switch requestPriority {
+	case "":
+	case "low", "high":
+		annotationsMap[priorityAnnotation] = requestPriority
+	default:
+		log.Fatalf("invalid priority %q, expected low or high", requestPriority)
+	}
+
+	if csrAttributesSecret != "" {
+		csrAttributes, err = readCSRAttributes(client, csrAttributesSecret, namespace)
+		if err != nil {
+			log.Fatalf("unable to read certificate request attributes: %s", err)
+		}
+	}
+
+	// The certificates API changed over the years: v1 since Kubernetes
+	// 1.19, v1beta1 until 1.22. Clusters serving both get v1, so do those
+	// not probed.
+	if issuerName == "kubernetes" && probeAPI && !diagnoseOnly {
+		caps, err := probeCluster(client)
+		if err != nil {
+			log.Printf("unable to probe the cluster, assuming it serves %s/%s: %s", certificatesGroup, certificatesVersion, err)
+		} else {
+			caps.log()
+			switch {
+			case caps.serves("v1"):
+				certificatesVersion = "v1"
+			case caps.serves("v1beta1"):
+				certificatesVersion = "v1beta1"
+			default:
+				log.Fatalf("the cluster serves neither %s/v1 nor v1beta1, which the kubernetes issuer requires", certificatesGroup)
+			}
+			log.Printf("using %s/%s", certificatesGroup, certificatesVersion)
+			if certDuration > 0 && caps.Version != "" && !caps.ExpirationSeconds {
+				log.Printf("-cert-duration is ignored by this cluster, the signer decides the duration of certificates")
+			}
+		}
+	}
+	if issuerName == "kubernetes" && !diagnoseOnly && certificatesVersion == "v1" && signerName == "" {
+		log.Fatalf("-signer-name is required by %s/v1", certificatesGroup)
+	}
+
+	iss, err := newIssuer(&issuerOptions{
+		client:      client,
+		labels:      labelsMap,
+		annotations: annotationsMap,
+	})
+	if err != nil {
+		log.Fatalf("unable to set up the %s issuer: %s", issuerName, err)
+	}
+
+	// Requests go through retries, fault injection and the CA cache. The
+	// issuer itself is kept to check for optional interfaces.
+	requests := withCachedCA(withTrustBundle(withRetries(withFaults(iss, injected)), trustDomainCA))
+
+	// done ends a successful run, unless the container stays around as a
+	// sidecar serving the CA.
+	done := func() {
+		if serveCAAddr != "" {
+			log.Fatal(serveCA(serveCAAddr, withTrustBundle(iss, trustDomainCA)))
+		}
+		os.Exit(0)
+	}
+
+	// Secrets for ingresses and the like are provisioned from a job, they
+	// are not tied to the identity of the pod.
+	if tlsHostnames != "" {
+		if secretName == "" {
+			log.Fatal("-hostnames requires -secret-name")
+		}
+		id := newIdentity(secretName, tlsHostnames)
+		if len(id.dnsNames) == 0 {
+			log.Fatal("no DNS names in -hostnames")
+		}
+		gateOnApprover(client)
+		issued, err := provision(client, requests, id, new(sync.Mutex))
+		if err != nil {
+			log.Fatalf("unable to provision secret %s: %s", secretName, err)
+		}
+		if issued {
+			log.Printf("Stored credentials in secret: (%s)", secretName)
+		} else {
+			log.Println("Secret is present and contains data, will exit.")
+		}
+		os.Exit(0)
+	}
+
+	if batchConfigMap != "" {
+		gateOnApprover(client)
+		if err := runBatch(client, requests, batchConfigMap, batchConcurrency, batchInterval); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// Client-only workloads just need to trust internal services.
+	if caOnly {
+		var dir string
+		if secretName == "" {
+			dir = certDir
+		}
+		if err := writeCAOnly(client, requests, dir); err != nil {
+			log.Fatal(err)
+		}
+		done()
+	}
+
+	files := []string{keyFileName, certFileName, caFileName}
+	if dualKeys {
+		files = []string{suffixed(keyFileName, "rsa"), suffixed(certFileName, "rsa"), suffixed(keyFileName, "ecdsa"), suffixed(certFileName, "ecdsa"), caFileName}
+	}
+	if pregenerated != nil {
+		files = files[1:]
+	}
+	if clientCert {
+		files = append(files, "client.key", "client.crt")
+	}
+
+	// Before we do anything, if we are storing in a secret, make sure it doesn't contain TLS data already.
+	var secret, existing *apiv1.Secret
+	if secretName != "" && !diagnoseOnly {
+		waiting := newLogThrottle()
+		start := clk.Now()
+		for {
+			ks, err := client.CoreV1().GetSecret(context.Background(), secretName, namespace)
+			if err != nil {
+				// Waiting doesn't grant missing permissions, only a
+				// secret that doesn't exist yet may still show up.
+				if apiErr, ok := err.(*k8s.APIError); ok {
+					switch apiErr.Code {
+					case http.StatusUnauthorized, http.StatusForbidden:
+						log.Fatalf("not allowed to read secret %s: %s; grant the pod's service account get and update on secrets in namespace %s, e.g. with a Role and RoleBinding", secretName, err, namespace)
+					case http.StatusUnprocessableEntity:
+						log.Fatalf("invalid secret name %s: %s", secretName, err)
+					}
+				}
+				if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusNotFound && createSecret {
+					tlsType := keyFileName == "tls.key" && certFileName == "tls.crt" && !derEncoding && !dualKeys && pregenerated == nil
+					secret, err = newSecret(secretName, tlsType)
+					if err != nil {
+						log.Fatal(err)
+					}
+					log.Printf("Secret to store credentials (%s) not found, it will be created", secretName)
+					break
+				}
+				if secretWaitTimeout > 0 && since(start) > secretWaitTimeout {
+					log.Fatalf("Secret to store credentials (%s) not found within %s: %s", secretName, secretWaitTimeout, err)
+				}
+				waiting.Printf("Secret to store credentials (%s) not found: %s", secretName, err)
+				clk.Sleep(5 * time.Second)
+				continue
+			}
+			secretData := ks.GetData()
+			for _, file := range files {
+				if _, present := secretData[file]; !present {
+					log.Printf("Missing file %s... continuing to generate keys and certificates", file)
+					secret = ks
+					break
+				}
+			}
+			if secret != nil {
+				break
+			}
+			if verifyExisting || renewCerts {
+				existing = ks
+				break
+			}
+			log.Println("Secret is present and contains data, will exit.")
+			done()
+		}
+	}
 	// Gather the list of IP addresses for the certificate's IP SANs field which
 	// include:
 	//   - the pod IP address
 	//   - each service IP address that maps to this pod
+	//
+	// Issuers that only sign their own hostnames drop these again, so they
+	// don't need the pod IP.
+	_, namesOnly := iss.(hostnameIssuer)
+	var ipaddresses []net.IP
 	ip := net.ParseIP(podIP)
-	if ip.To4() == nil && ip.To16() == nil {
+	if ip != nil {
+		ipaddresses = append(ipaddresses, ip)
+	} else if !namesOnly {
 		log.Fatal("invalid pod IP address")
 	}
 
-	ipaddresses := []net.IP{ip}
-
 	for _, s := range strings.Split(serviceIPs, ",") {
 		if s == "" {
 			continue
@@ -216,136 +845,534 @@ func main() {
 		dnsNames = append(dnsNames, serviceDomainName(n, namespace, clusterDomain))
 	}
 
-	// We need to make sure to send in uninitialized values if no value is set, otherwise we get empty fields
-	// in the CSR
-	var (
-		nameCountry            []string
-		nameOrganization       []string
-		nameOrganizationalUnit []string
-	)
-	if len(countries) > 0 {
-		nameCountry = strings.Split(countries, ",")
+	// Services can opt in to being named in the certificates of the pods
+	// they select, keeping the names next to what makes them reachable.
+	if annotatedSvcs {
+		if podName == "" && podInfoDir == "" {
+			log.Fatal("-annotated-services requires -pod-name or -pod-info-dir to find the pod's labels")
+		}
+		podLabels, err := readPodLabels(client, podName, namespace)
+		if err != nil {
+			log.Fatalf("unable to read pod labels: %s", err)
+		}
+		svcs, err := annotatedServices(client, namespace, podLabels)
+		if err != nil {
+			log.Fatalf("unable to list services: %s", err)
+		}
+		for _, n := range svcs {
+			log.Printf("including service %s", n)
+			dnsNames = append(dnsNames, serviceDomainName(n, namespace, clusterDomain))
+		}
 	}
-	if len(organizations) > 0 {
-		nameOrganization = strings.Split(organizations, ",")
+
+	// The order otherwise follows from the flags the names came from.
+	if sanOrder != "" {
+		patterns, err := parseSANOrder(sanOrder)
+		if err != nil {
+			log.Fatalf("invalid -san-order: %s", err)
+		}
+		dnsNames = orderNames(dnsNames, patterns)
 	}
-	if len(organizationalUnits) > 0 {
-		nameOrganizationalUnit = strings.Split(organizationalUnits, ",")
+
+	if noDNSNames {
+		dnsNames = nil
 	}
-	// Generate the certificate request, pem encode it, and save it to the filesystem.
-	certificateRequestTemplate := x509.CertificateRequest{
-		Subject: pkix.Name{
-			CommonName:         dnsNames[0],
-			Country:            nameCountry,
-			Organization:       nameOrganization,
-			OrganizationalUnit: nameOrganizationalUnit,
-		},
-		SignatureAlgorithm: x509.SHA256WithRSA,
-		DNSNames:           dnsNames,
-		IPAddresses:        ipaddresses,
+
+	var uris []*url.URL
+	uriTemplate := strings.NewReplacer("${trustdomain}", trustDomain, "${namespace}", namespace)
+	for _, s := range strings.Split(uriSANs, ",") {
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(uriTemplate.Replace(s))
+		if err != nil || u.Scheme == "" {
+			log.Fatalf("invalid URI %q", s)
+		}
+		if trustDomain != "" && u.Scheme == "spiffe" && u.Host != trustDomain {
+			log.Fatalf("SPIFFE ID %s is not in trust domain %s", u, trustDomain)
+		}
+		uris = append(uris, u)
 	}
 
-	certificateRequest, err := x509.CreateCertificateRequest(rand.Reader, &certificateRequestTemplate, key)
-	if err != nil {
-		log.Fatalf("unable to generate the certificate request: %s", err)
+	// Some issuers only sign names they are responsible for, which replace
+	// the in-cluster names and IP addresses. The additional DNS names are
+	// kept, those are the names to request from such issuers.
+	if h, ok := iss.(hostnameIssuer); ok {
+		hostnames, err := h.Hostnames()
+		if err != nil {
+			log.Fatalf("unable to discover the hostnames to request: %s", err)
+		}
+
+		dnsNames = nil
+		for _, n := range strings.Split(additionalDNSNames, ",") {
+			if n == "" {
+				continue
+			}
+			dnsNames = append(dnsNames, n)
+		}
+		dnsNames = append(dnsNames, hostnames...)
+		if len(dnsNames) == 0 {
+			log.Fatalf("no hostnames to request a certificate for from the %s issuer", issuerName)
+		}
+		ipaddresses = nil
+	}
+
+	if verifyDNSNames {
+		checkDNSNames(dnsNames, ipaddresses)
+	}
+
+	// Approver policies commonly match on the service account identity.
+	if subjectFromSA {
+		username, err := serviceAccountUsername(serviceAccount, namespace)
+		if err != nil {
+			log.Fatalf("unable to determine the service account: %s", err)
+		}
+		if commonName == "" {
+			commonName = username
+		}
+		if organizations == "" {
+			organizations = namespace
+		}
+	}
+
+	// Gateways authenticating on UPN-style names want to see the identity
+	// of the workload in an otherName.
+	var otherNames []otherName
+	if otherNameSAN != "" {
+		var username string
+		if strings.Contains(otherNameSAN, "${serviceaccount}") {
+			var err error
+			username, err = serviceAccountUsername(serviceAccount, namespace)
+			if err != nil {
+				log.Fatalf("unable to determine the service account: %s", err)
+			}
+		}
+		n, err := parseOtherName(strings.NewReplacer("${namespace}", namespace, "${pod}", podName, "${serviceaccount}", username).Replace(otherNameSAN))
+		if err != nil {
+			log.Fatal(err)
+		}
+		otherNames = append(otherNames, n)
+	}
+
+	// Without DNS names the CN is only set if asked for.
+	cn := commonName
+	if cn == "" && len(dnsNames) > 0 {
+		cn = dnsNames[0]
 	}
+	subject := subjectName(cn)
 
-	certificateRequestBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: certificateRequest})
+	// Without a secret the results are written to the filesystem, unless
+	// they are handed over.
+	var dir string
+	if secretName == "" && handoverFIFO == "" {
+		dir = certDir
+	}
+
+	certs := []*certificate{{
+		name:        certificateSigningRequestName,
+		dir:         dir,
+		keyFile:     keyFileName,
+		csrFile:     csrFileName,
+		certFile:    certFileName,
+		subject:     subject,
+		dnsNames:    dnsNames,
+		ipAddresses: ipaddresses,
+		uris:        uris,
+		otherNames:  otherNames,
+		usages:      defaultUsages(),
+	}}
+	certs[0].setOutputFiles(false)
+	if pregenerated != nil {
+		csr, _ := parseRequest(pregenerated)
+		certs[0].request = pregenerated
+		certs[0].subject = csr.Subject
+		certs[0].dnsNames = csr.DNSNames
+		certs[0].ipAddresses = csr.IPAddresses
+		certs[0].uris = csr.URIs
+		certs[0].otherNames = nil
+	}
 
-	if secretName == "" {
-		csrFile := path.Join(certDir, "tls.csr")
-		if err := ioutil.WriteFile(csrFile, certificateRequestBytes, 0644); err != nil {
-			log.Fatalf("unable to %s, error: %s", csrFile, err)
+	if dualKeys {
+		format := func(algorithm string) string {
+			if keyFormatSet {
+				return keyFormat
+			}
+			return defaultKeyFormat(algorithm)
 		}
+		rsaCert := certs[0].variant("rsa", "rsa", format("rsa"))
+		ecdsaCert := certs[0].variant("ecdsa", "ecdsa", format("ecdsa"))
+		// Both share the CA chain.
+		rsaCert.caChainFile, ecdsaCert.caChainFile = certs[0].caChainFile, ""
+		certs = []*certificate{rsaCert, ecdsaCert}
+	}
 
-		log.Printf("wrote %s", csrFile)
+	// A separate client identity shares the CA of the server certificate,
+	// which in turn is restricted to server usages.
+	if clientCert {
+		clientSubject := subject
+		if clientCommonName != "" {
+			clientSubject.CommonName = clientCommonName
+		}
+		for _, c := range certs {
+			c.usages = serverUsages
+		}
+		client := &certificate{
+			name:       certificateSigningRequestName + "-client",
+			dir:        dir,
+			keyFile:    "client.key",
+			csrFile:    "client.csr",
+			certFile:   "client.crt",
+			subject:    clientSubject,
+			otherNames: otherNames,
+			usages:     clientUsages,
+		}
+		client.setOutputFiles(true)
+		certs = append(certs, client)
 	}
 
-	// Submit a certificate signing request, wait for it to be approved, then save
-	// the signed certificate to the file system.
-	certificateSigningRequest := &certificates.CertificateSigningRequest{
-		Metadata: &v1.ObjectMeta{
-			Name:   k8s.String(certificateSigningRequestName),
-			Labels: labelsMap,
-		},
-		Spec: &certificates.CertificateSigningRequestSpec{
-			Groups:   []string{"system:authenticated"},
-			Request:  certificateRequestBytes,
-			KeyUsage: []string{"digital signature", "key encipherment", "server auth", "client auth"},
-		},
+	if diagnoseOnly {
+		if err := diagnose(os.Stdout, client, requests, certs, labelsMap, annotationsMap); err != nil {
+			log.Fatalf("unable to write the diagnosis: %s", err)
+		}
+		os.Exit(0)
 	}
 
-	log.Printf("Deleting certificate signing request  %s", certificateSigningRequestName)
-	client.CertificatesV1Beta1().DeleteCertificateSigningRequest(context.Background(), certificateSigningRequestName)
-	log.Printf("Removed approved request %s", certificateSigningRequestName)
+	// An already populated secret is only left alone if its contents would
+	// still satisfy this request.
+	if existing != nil && verifyExisting {
+		data := existing.GetData()
+		podNames := map[string]bool{}
+		if ip != nil {
+			podNames[ip.String()] = true
+		}
+		for _, n := range defaultDNSNames(podIP, hostname, subdomain, namespace, clusterDomain) {
+			podNames[n] = true
+		}
+		for _, c := range certs {
+			// With -leaf-only or -encoding=der the intermediates are only in
+			// chain.pem.
+			cert := decodeStoredCert(data[c.certFile])
+			if (leafOnly || derEncoding) && c.chainFile != "" {
+				cert = append(append([]byte(nil), cert...), data[c.chainFile]...)
+			}
+			if err := verifyCertificate(c, decodeStoredKey(data[c.keyFile]), cert, data[caFileName], podNames); err != nil {
+				log.Fatalf("Secret %s is present but unusable: %s", secretName, err)
+			}
+		}
+	}
+	if existing != nil && !renewCerts {
+		log.Println("Secret is present and contains valid data, will exit.")
+		done()
+	}
 
-	_, err = client.CertificatesV1Beta1().GetCertificateSigningRequest(context.Background(), certificateSigningRequestName)
+	// A restarted sidecar picks up where it left off, with the files it
+	// wrote if they are all there.
+	state, err := loadRenewalState(client, stateStore)
 	if err != nil {
-		_, err = client.CertificatesV1Beta1().CreateCertificateSigningRequest(context.Background(), certificateSigningRequest)
-		if err != nil {
-			log.Fatalf("unable to create the certificate signing request: %s", err)
+		log.Fatalf("unable to read the renewal state: %s", err)
+	}
+	var handed *handover
+	if handoverFIFO != "" {
+		if handed, err = newHandover(handoverFIFO); err != nil {
+			log.Fatalf("unable to create %s: %s", handoverFIFO, err)
+		}
+	}
+	var chains [][]byte
+	resumed := false
+	if existing == nil && dir != "" && !state.LastIssued.IsZero() {
+		if chains, resumed = readIssued(certs, dir); resumed {
+			log.Printf("resuming with the certificates issued at %s in %s", state.LastIssued.UTC(), dir)
 		}
-		log.Println("waiting for certificate...")
-	} else {
-		log.Println("signing request already exists")
+	}
+	if existing != nil {
+		// The keystores of an earlier run are protected by the password
+		// it rotated to.
+		if password := existing.GetData()[keystorePasswordKey]; rotatePKCS12 && len(password) > 0 {
+			keystorePassword = string(password)
+			previousPassword = string(existing.GetData()[previousPasswordKey])
+		}
+		for _, c := range certs {
+			chains = append(chains, decodeStoredCert(existing.GetData()[c.certFile]))
+			// The key is only known from when its certificate was issued.
+			if err := c.loadKey(existing.GetData()[c.keyFile], chains[len(chains)-1]); err != nil {
+				log.Printf("unable to reuse the private key of %s, it will be replaced: %s", c.name, err)
+			}
+		}
+	} else if !resumed {
+		chains = issueAll(client, requests, certs, dir, secret)
+		if handed != nil {
+			handed.offerIssued(client, requests, certs)
+		}
+		state.LastIssued = clk.Now()
+		state.Failures = 0
+	}
+	if !renewCerts {
+		done()
+	}
+	if existing != nil || resumed {
+		state.restoreKeys(certs)
 	}
 
-	var certificate []byte
+	// As a sidecar, the certificates are issued anew before they expire,
+	// -serve-ca keeps serving meanwhile.
+	if serveCAAddr != "" {
+		go func() {
+			log.Fatal(serveCA(serveCAAddr, withTrustBundle(iss, trustDomainCA)))
+		}()
+	}
+	// While the cluster rotates its CA the certificates are also issued
+	// anew once the signer switched to the new CA.
+	var rotation []string
+	var written []byte
+	if rotationCAs != "" {
+		rotation = strings.Split(rotationCAs, ",")
+		bundles, err := readRotationCAs(client, rotation)
+		if err != nil {
+			log.Fatal(err)
+		}
+		written = mergeBundles(bundles...)
+	}
+	fresh := existing == nil && !resumed
 	for {
-		csr, err := client.CertificatesV1Beta1().GetCertificateSigningRequest(context.Background(), certificateSigningRequestName)
+		next, err := renewal.nextRenewal(chains)
 		if err != nil {
-			log.Printf("unable to retrieve certificate signing request (%s): %s", certificateSigningRequestName, err)
-			time.Sleep(5 * time.Second)
-			continue
+			log.Fatalf("unable to schedule the renewal: %s", err)
+		}
+		// Certificates due as soon as they are issued would otherwise be
+		// requested back to back.
+		if fresh && !next.After(clk.Now()) {
+			next = clk.Now().Add(minRenewalInterval)
+			log.Printf("the certificates just issued are already due for renewal, -renew-before is not shorter than their lifetime; renewing again in %s", minRenewalInterval)
+		}
+		// Failed renewals are retried later and later, also after a
+		// restart.
+		if retry := state.retryAt(); next.Before(retry) {
+			next = retry
+			log.Printf("%d renewals failed, retrying at %s", state.Failures, retry.UTC())
 		}
+		state.NextRenewal = next
+		if err := state.save(client, stateStore, certs); err != nil {
+			log.Printf("unable to save the renewal state: %s", err)
+		}
+		if wait := next.Sub(clk.Now()); wait > 0 {
+			log.Printf("next renewal at %s", next.UTC())
+			if rotation == nil {
+				clk.Sleep(wait)
+			}
+		}
+		for rotation != nil && clk.Now().Before(next) {
+			wait := next.Sub(clk.Now())
+			if wait > rotationCheck {
+				wait = rotationCheck
+			}
+			clk.Sleep(wait)
 
-		if len(csr.GetStatus().GetConditions()) > 0 {
-			if *csr.GetStatus().GetConditions()[0].Type == "Approved" {
-				certificate = csr.GetStatus().Certificate
-				if len(certificate) > 1 {
-					log.Printf("got crt %s", certificate)
-					break
-				} else {
-					log.Printf("cert length still less than 1, wait to populate. Cert: %s", csr.GetStatus())
+			bundles, err := readRotationCAs(client, rotation)
+			if err != nil {
+				log.Printf("unable to check for a CA rotation: %s", err)
+				continue
+			}
+			due, err := rotationDue(chains, bundles, written)
+			if err != nil {
+				log.Fatalf("unable to check for a CA rotation: %s", err)
+			}
+			if due {
+				log.Printf("the CA is being rotated, renewing certificates early")
+				written = mergeBundles(bundles...)
+				if cached, ok := requests.(*cachingIssuer); ok {
+					cached.forget()
 				}
+				break
+			}
+		}
+		log.Printf("renewing certificates")
+		for _, c := range certs {
+			c.reuseKey = !rekey.due(c.renewals, c.keyCreated)
+		}
+		if rotatePKCS12 {
+			if err := rotateKeystorePassword(); err != nil {
+				log.Fatalf("unable to generate the keystore password: %s", err)
+			}
+			log.Printf("rotated the keystore password")
+		}
+		state.LastAttempt = clk.Now()
+		state.Failures++
+		if err := state.save(client, stateStore, certs); err != nil {
+			log.Printf("unable to save the renewal state: %s", err)
+		}
+		chains = issueAll(client, requests, certs, dir, nil)
+		if handed != nil {
+			handed.offerIssued(client, requests, certs)
+		}
+		state.LastIssued = clk.Now()
+		state.Failures = 0
+		fresh = true
+	}
+}
 
+// issueAll obtains certificates for certs and stores them in dir or in
+// secret, read anew if nil and -secret-name is set. It returns the chains
+// issued.
+func issueAll(client *k8s.Client, requests issuer, certs []*certificate, dir string, secret *apiv1.Secret) [][]byte {
+	gateOnApprover(client)
+
+	if secret == nil && secretName != "" {
+		var err error
+		secret, err = client.CoreV1().GetSecret(context.Background(), secretName, namespace)
+		if err != nil {
+			log.Fatalf("unable to read secret %s: %s", secretName, err)
+		}
+	}
+
+	var staging string
+	if atomicWrites && dir != "" {
+		var err error
+		staging, err = stageDir(dir)
+		if err != nil {
+			log.Fatalf("unable to create a staging directory in %s: %s", dir, err)
+		}
+		for _, c := range certs {
+			c.dir = staging
+		}
+	}
+
+	result := &issuanceResult{Policy: failurePolicy}
+	var issued []*certificate
+	for _, c := range certs {
+		err := c.obtain(requests)
+		result.add(c, err)
+		if err != nil && failurePolicy == partialFailureFail {
+			recordMetrics(certs, result)
+			log.Fatal(err)
+		}
+		if err != nil {
+			log.Printf("unable to obtain a certificate for %s: %s", c.name, err)
+			continue
+		}
+		issued = append(issued, c)
+	}
+	if len(certs) > 1 {
+		log.Printf("result: %s", result)
+	}
+	recordMetrics(certs, result)
+	if len(issued) == 0 {
+		log.Fatal("no certificate was issued")
+	}
+
+	rendered, err := renderTemplates(outputTemplates, issued, dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dir != "" {
+		target := dir
+		if staging != "" {
+			target = staging
+		}
+		for name, data := range rendered {
+			file := path.Join(target, name)
+			if err := writeFile(file, data, false); err != nil {
+				log.Fatalf("unable to write to %s: %s", file, err)
 			}
-		} else {
-			log.Printf("certificate signing request (%s) not approved; trying again in 5 seconds", certificateSigningRequestName)
+			log.Printf("wrote %s", file)
 		}
+	}
 
-		time.Sleep(5 * time.Second)
+	if staging != "" {
+		if err := publishDir(dir, staging); err != nil {
+			log.Fatalf("unable to publish the files in %s: %s", dir, err)
+		}
+		log.Printf("published %s", dir)
 	}
 
-	if secretName == "" {
-		certFile := path.Join(certDir, "tls.crt")
-		if err := ioutil.WriteFile(certFile, certificate, 0644); err != nil {
-			log.Fatalf("unable to write to %s: %s", certFile, err)
+	var audit []*auditEntry
+	if auditLog != "" || auditHistory > 0 {
+		for _, c := range issued {
+			e, err := newAuditEntry(c)
+			if err != nil {
+				log.Fatalf("unable to record the issuance: %s", err)
+			}
+			audit = append(audit, e)
+		}
+	}
+	if auditLog != "" {
+		if err := appendAuditLog(auditLog, audit); err != nil {
+			log.Fatalf("unable to write to %s: %s", auditLog, err)
 		}
-		log.Printf("wrote %s", certFile)
 	}
 
-	log.Printf("Deleting certificate signing request  %s", certificateSigningRequestName)
-	client.CertificatesV1Beta1().DeleteCertificateSigningRequest(context.Background(), certificateSigningRequestName)
-	log.Printf("Removed approved request %s", certificateSigningRequestName)
+	// Updating the pod requires permission to do so, which is not worth
+	// failing over.
+	if latencyAnnotations && podName != "" {
+		if err := annotatePod(client, podName, namespace, func(annotations map[string]string) {
+			setLatencyAnnotations(annotations, issued)
+		}); err != nil {
+			log.Printf("unable to annotate pod %s: %s", podName, err)
+		}
+	}
+
+	if trustBundleFile != "" {
+		ca, err := trustedCAs(client, requests)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := updateTrustBundle(trustBundleFile, ca, issuerName); err != nil {
+			log.Fatalf("unable to update the trust bundle %s: %s", trustBundleFile, err)
+		}
+		log.Printf("updated %s", trustBundleFile)
+	}
 
 	if secret != nil {
-		k8sCrt, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+		k8sCrt, err := trustedCAs(client, requests)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
+		for name, data := range rendered {
+			if secret.Data == nil {
+				secret.Data = make(map[string][]byte)
+			}
+			secret.Data[name] = data
+		}
+		if err := writeSecret(client, secret, issued, caFileName, k8sCrt, audit); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Stored credentials in secret: (%s)", secretName)
+	}
 
-		stringData := make(map[string]string)
-		stringData["tls.key"] = string(pemKeyBytes)
-		stringData["tls.crt"] = string(certificate)
-		stringData["ca.crt"] = string(k8sCrt) // ok
+	if n := result.failed(); n > 0 && failurePolicy == partialFailureContinue {
+		log.Fatalf("%d of %d certificates were not issued", n, len(result.Certificates))
+	}
 
-		secret.StringData = stringData
-		_, err = client.CoreV1().UpdateSecret(context.TODO(), secret)
-		log.Printf("Stored credentials in secret: (%s)", secretName)
+	var chains [][]byte
+	for _, c := range issued {
+		chains = append(chains, c.cert)
 	}
+	return chains
+}
 
-	os.Exit(0)
+// subjectName returns the subject of certificate requests for commonName.
+func subjectName(commonName string) pkix.Name {
+	// We need to make sure to send in uninitialized values if no value is set, otherwise we get empty fields
+	// in the CSR
+	var (
+		nameCountry            []string
+		nameOrganization       []string
+		nameOrganizationalUnit []string
+	)
+	if len(countries) > 0 {
+		nameCountry = strings.Split(countries, ",")
+	}
+	if len(organizations) > 0 {
+		nameOrganization = strings.Split(organizations, ",")
+	}
+	if len(organizationalUnits) > 0 {
+		nameOrganizationalUnit = strings.Split(organizationalUnits, ",")
+	}
+	return pkix.Name{
+		CommonName:         commonName,
+		Country:            nameCountry,
+		Organization:       nameOrganization,
+		OrganizationalUnit: nameOrganizationalUnit,
+	}
 }
 
 func defaultDNSNames(ip, hostname, subdomain, namespace, clusterDomain string) []string {
@@ -362,16 +1389,48 @@ func defaultDNSNames(ip, hostname, subdomain, namespace, clusterDomain string) [
 }
 
 func serviceDomainName(name, namespace, domain string) string {
-	return fmt.Sprintf("%s.%s.svc.%s", name, namespace, domain)
+	return strings.NewReplacer("${name}", name, "${namespace}", namespace, "${domain}", domain).Replace(svcDomainFormat)
 }
 
 func podDomainName(ip, namespace, domain string) string {
-	return fmt.Sprintf("%s.%s.pod.%s", strings.Replace(ip, ".", "-", -1), namespace, domain)
+	return strings.NewReplacer("${ip}", strings.Replace(ip, ".", "-", -1), "${namespace}", namespace, "${domain}", domain).Replace(podDomainFormat)
 }
 
+// podHeadlessDomainName returns the name of a pod with a hostname in the
+// headless service named by its subdomain.
 func podHeadlessDomainName(hostname, subdomain, namespace, domain string) string {
 	if hostname == "" || subdomain == "" {
 		return ""
 	}
-	return fmt.Sprintf("%s.%s.%s.svc.%s", hostname, subdomain, namespace, domain)
+	return hostname + "." + serviceDomainName(subdomain, namespace, domain)
+}
+
+// checkDNSNames logs a warning for each DNS name that does not resolve to
+// one of the given IP addresses. Names that resolve elsewhere, or not at
+// all, usually point at a typo in the names passed to this container.
+func checkDNSNames(dnsNames []string, ips []net.IP) {
+	for _, n := range dnsNames {
+		addrs, err := net.LookupIP(n)
+		if err != nil {
+			log.Printf("warning: %s does not resolve: %s", n, err)
+			continue
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		if !containsIP(ips, addrs) {
+			log.Printf("warning: %s resolves to %v, none of which is in %v", n, addrs, ips)
+		}
+	}
+}
+
+func containsIP(ips, addrs []net.IP) bool {
+	for _, addr := range addrs {
+		for _, ip := range ips {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// A metric is an OpenMetrics gauge along with its samples, one per
+// certificate.
+type metric struct {
+	name, unit, help string
+	samples          map[string]float64
+}
+
+// writeMetrics writes the outcome of a run as an OpenMetrics snapshot to
+// file, for an exporter of the application, e.g. the textfile collector of
+// the node exporter, to expose. certs are the certificates requested.
+func writeMetrics(file string, certs []*certificate, result *issuanceResult) error {
+	issued := &metric{name: "certificate_init_issued", help: "Whether the certificate was issued by the last run."}
+	expiry := &metric{name: "certificate_init_expiry_timestamp_seconds", unit: "seconds", help: "When the certificate expires."}
+	approval := &metric{name: "certificate_init_approval_duration_seconds", unit: "seconds", help: "How long the request waited for approval."}
+	issuance := &metric{name: "certificate_init_issuance_duration_seconds", unit: "seconds", help: "How long the certificate took to be issued."}
+	metrics := []*metric{issued, expiry, approval, issuance}
+	for _, m := range metrics {
+		m.samples = make(map[string]float64)
+	}
+
+	for _, r := range result.Certificates {
+		issued.samples[r.Name] = 0
+		if r.Issued {
+			issued.samples[r.Name] = 1
+		}
+	}
+	for _, c := range certs {
+		if issued.samples[c.name] == 0 || c.cert == nil {
+			continue
+		}
+		chain, err := parseChain(c.cert)
+		if err != nil {
+			return err
+		}
+		expiry.samples[c.name] = float64(chain[0].NotAfter.Unix())
+		approval.samples[c.name] = c.approvedAfter.Seconds()
+		issuance.samples[c.name] = c.issuedAfter.Seconds()
+	}
+
+	var b bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", m.name)
+		if m.unit != "" {
+			fmt.Fprintf(&b, "# UNIT %s %s\n", m.name, m.unit)
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		for _, r := range result.Certificates {
+			if v, ok := m.samples[r.Name]; ok {
+				fmt.Fprintf(&b, "%s{certificate=\"%s\"} %s\n", m.name, labelValue.Replace(r.Name), strconv.FormatFloat(v, 'f', -1, 64))
+			}
+		}
+	}
+	fmt.Fprintf(&b, "# TYPE certificate_init_last_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(&b, "# UNIT certificate_init_last_run_timestamp_seconds seconds\n")
+	fmt.Fprintf(&b, "certificate_init_last_run_timestamp_seconds %d\n", clk.Now().Unix())
+	b.WriteString("# EOF\n")
+
+	// Scrapers must never see half a file.
+	tmp := file + ".tmp"
+	if err := writeFile(tmp, b.Bytes(), false); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// recordMetrics writes the metrics of a run to -metrics-file, if set.
+// Metrics are not worth failing a run over.
+func recordMetrics(certs []*certificate, result *issuanceResult) {
+	if metricsFile == "" {
+		return
+	}
+	if err := writeMetrics(metricsFile, certs, result); err != nil {
+		log.Printf("unable to write metrics to %s: %s", metricsFile, err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// meshHint tells how to take the API server out of the mesh, for init
+// containers running before the sidecar proxy that captures their traffic.
+const meshHint = "if a service mesh redirects the pod's traffic, exclude the API server, e.g. with the " +
+	"traffic.sidecar.istio.io/excludeOutboundIPRanges or config.linkerd.io/skip-outbound-ports annotations, " +
+	"or run the mesh's init container after this one"
+
+// waitForNetwork waits up to timeout for the proxy at readyURL, if set, to
+// report ready and then for the API server to answer, so a mesh whose
+// proxy isn't up yet delays the container rather than failing it.
+func waitForNetwork(client *k8s.Client, readyURL string, timeout time.Duration) error {
+	start := clk.Now()
+	waiting := newLogThrottle()
+
+	if readyURL != "" {
+		c := &http.Client{Timeout: 5 * time.Second}
+		for {
+			resp, err := c.Get(readyURL)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					break
+				}
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+			if since(start) > timeout {
+				return fmt.Errorf("proxy not ready after %s: %s", timeout, err)
+			}
+			waiting.Printf("waiting for the proxy at %s: %s", readyURL, err)
+			clk.Sleep(time.Second)
+		}
+		log.Printf("proxy at %s is ready", readyURL)
+	}
+
+	for {
+		_, err := client.Discovery().Version(context.Background())
+		if err == nil {
+			return nil
+		}
+		if since(start) > timeout {
+			return fmt.Errorf("API server %s not reachable after %s: %s; %s", client.Endpoint, timeout, err, meshHint)
+		}
+		waiting.Printf("waiting for the API server %s: %s", client.Endpoint, err)
+		clk.Sleep(time.Second)
+	}
+}
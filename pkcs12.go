@@ -0,0 +1,386 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/ericchiang/k8s"
+)
+
+// PKCS#12 keystores are written the way OpenSSL 3 writes them by default:
+// the key encrypted with PBES2, see encryptPrivateKey, the certificates in
+// the clear and the whole protected by an HMAC-SHA256. Java reads them
+// since 8u301 and 11.0.12.
+const pkcs12Iterations = 2048
+
+// pkcs12PasswordEnv holds the keystore password unless -pkcs12-password
+// is set.
+const pkcs12PasswordEnv = "PKCS12_PASSWORD"
+
+// pkcs12MACKeyID is the purpose of key material derived for the MAC.
+const pkcs12MACKeyID = 3
+
+// With -pkcs12-rotate-password the keystore password is stored in the
+// secret under keystorePasswordKey, the one before the last rotation under
+// previousPasswordKey.
+const (
+	keystorePasswordKey = "keystore.password"
+	previousPasswordKey = "keystore.password.previous"
+)
+
+// previousPassword is the keystore password before the last rotation.
+var previousPassword string
+
+var (
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidShroudedKeyBag  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	asn1NULL           = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+// Java marks the certificates of a truststore as trusted with an attribute
+// holding the extended key usages they are trusted for.
+var (
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     // [0] EXPLICIT
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// encodePKCS12 returns a DER encoded PKCS#12 keystore holding the private
+// key in keyPEM and the certificates of chain, the leaf first, protected
+// by password. The key and the leaf are named alias.
+func encodePKCS12(keyPEM []byte, chain []*x509.Certificate, alias, password string) ([]byte, error) {
+	key, err := pkcs8Key(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key and its certificate are tied by the digest of the latter.
+	localKeyID := sha1.Sum(chain[0].Raw)
+	leafAttributes, err := bagAttributes(alias, localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	seen := make(map[string]bool)
+	for i, cert := range chain {
+		if seen[string(cert.Raw)] {
+			continue
+		}
+		seen[string(cert.Raw)] = true
+		b, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: cert.Raw})
+		if err != nil {
+			return nil, err
+		}
+		bag := safeBag{ID: oidCertBag, Value: explicit(b)}
+		if i == 0 {
+			bag.Attributes = leafAttributes
+		}
+		certBags = append(certBags, bag)
+	}
+
+	shrouded, err := encryptPrivateKey(key, password)
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []safeBag{{ID: oidShroudedKeyBag, Value: explicit(shrouded), Attributes: leafAttributes}}
+	return marshalPFX([][]safeBag{certBags, keyBags}, password)
+}
+
+// encodeTruststore returns a DER encoded PKCS#12 truststore holding certs
+// as trusted certificates, protected by password.
+func encodeTruststore(certs []*x509.Certificate, password string) ([]byte, error) {
+	usage, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+	trusted := pkcs12Attribute{ID: oidJavaTrustedKeyUsage, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: usage}}
+
+	var certBags []safeBag
+	for i, cert := range certs {
+		name, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(fmt.Sprintf("ca-%d", i))})
+		if err != nil {
+			return nil, err
+		}
+		b, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: cert.Raw})
+		if err != nil {
+			return nil, err
+		}
+		certBags = append(certBags, safeBag{ID: oidCertBag, Value: explicit(b), Attributes: []pkcs12Attribute{
+			{ID: oidFriendlyName, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: name}},
+			trusted,
+		}})
+	}
+	return marshalPFX([][]safeBag{certBags}, password)
+}
+
+// marshalPFX returns the DER encoded PFX of the safe contents, each a list
+// of bags, with an HMAC-SHA256 keyed by password.
+func marshalPFX(safes [][]safeBag, password string) ([]byte, error) {
+	var authSafe []contentInfo
+	for _, bags := range safes {
+		ci, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, ci)
+	}
+	content, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(randReader, salt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, pkcs12KDF(sha256.New, pkcs12MACKeyID, append(bmpString(password), 0, 0), salt, pkcs12Iterations, sha256.Size))
+	mac.Write(content)
+
+	octets, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfx{
+		Version: 3,
+		AuthSafe: contentInfo{
+			ContentType: oidData,
+			Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets},
+		},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1NULL},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// readKeystorePassword returns the keystore password given as password,
+// in pkcs12PasswordEnv, or in the secret given as name/key in namespace,
+// in that order.
+func readKeystorePassword(client *k8s.Client, password, secret, namespace string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	if password := os.Getenv(pkcs12PasswordEnv); password != "" {
+		return password, nil
+	}
+	if secret == "" {
+		return "", fmt.Errorf("no keystore password, set -pkcs12-password, %s or -pkcs12-password-secret", pkcs12PasswordEnv)
+	}
+	s := strings.SplitN(secret, "/", 2)
+	if len(s) != 2 {
+		return "", fmt.Errorf("invalid secret %q, expected name/key", secret)
+	}
+	ks, err := client.CoreV1().GetSecret(context.Background(), s[0], namespace)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret %s: %s", s[0], err)
+	}
+	data, ok := ks.GetData()[s[1]]
+	if !ok || len(data) == 0 {
+		return "", fmt.Errorf("secret %s has no %s key", s[0], s[1])
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// rotateKeystorePassword replaces the keystore password with a new random
+// one, keeping the current one as previousPassword.
+func rotateKeystorePassword() error {
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return err
+	}
+	previousPassword, keystorePassword = keystorePassword, base64.RawURLEncoding.EncodeToString(b)
+	return nil
+}
+
+// pkcs8Key returns the PKCS#8 encoding of the PEM encoded private key.
+func pkcs8Key(keyPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return block.Bytes, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(key)
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(key)
+	}
+	return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+}
+
+func bagAttributes(alias string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	name, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(alias)})
+	if err != nil {
+		return nil, err
+	}
+	id, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: name}},
+		{ID: oidLocalKeyID, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: id}},
+	}, nil
+}
+
+// explicit tags DER encoded der as [0] EXPLICIT.
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// dataContentInfo wraps bags in an unencrypted data ContentInfo.
+func dataContentInfo(bags []safeBag) (contentInfo, error) {
+	b, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	octets, err := asn1.Marshal(b)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{
+		ContentType: oidData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets},
+	}, nil
+}
+
+// pkcs12KDF derives size bytes of key material for the given purpose, id,
+// from password as in RFC 7292, appendix B.2.
+func pkcs12KDF(newHash func() hash.Hash, id byte, password, salt []byte, iterations, size int) []byte {
+	h := newHash()
+	v := h.BlockSize()
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	I := append(fill(salt), fill(password)...)
+
+	var out []byte
+	one := big.NewInt(1)
+	for len(out) < size {
+		h.Reset()
+		h.Write(d)
+		h.Write(I)
+		a := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		out = append(out, a...)
+
+		// I_j = (I_j + B + 1) mod 2^(8v) for each v byte block of I.
+		b := new(big.Int).SetBytes(fill(a)[:v])
+		b.Add(b, one)
+		for j := 0; j < len(I); j += v {
+			ij := new(big.Int).SetBytes(I[j : j+v])
+			ij.Add(ij, b)
+			sum := ij.Bytes()
+			if len(sum) > v {
+				sum = sum[len(sum)-v:]
+			}
+			block := I[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(sum):], sum)
+		}
+	}
+	return out[:size]
+}
+
+// bmpString returns s as a big-endian UTF-16 string. Passwords are given
+// to the PKCS#12 KDF that way, followed by two zero bytes.
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return b
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+// decodePFX checks the MAC of the DER encoded PKCS#12 store der and returns
+// its bags.
+func decodePFX(t *testing.T, der []byte, password string) []safeBag {
+	var p pfx
+	if rest, err := asn1.Unmarshal(der, &p); err != nil || len(rest) > 0 {
+		t.Fatalf("unable to parse the PFX: %v", err)
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(p.AuthSafe.Content.Bytes, &content); err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, pkcs12KDF(sha256.New, pkcs12MACKeyID, append(bmpString(password), 0, 0), p.MacData.MacSalt, p.MacData.Iterations, sha256.Size))
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), p.MacData.Mac.Digest) {
+		t.Fatal("MAC mismatch")
+	}
+
+	var authSafe []contentInfo
+	if _, err := asn1.Unmarshal(content, &authSafe); err != nil {
+		t.Fatal(err)
+	}
+	var bags []safeBag
+	for _, ci := range authSafe {
+		if !ci.ContentType.Equal(oidData) {
+			t.Fatalf("content type %s, want data", ci.ContentType)
+		}
+		var safe []byte
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &safe); err != nil {
+			t.Fatal(err)
+		}
+		var contents []safeBag
+		if _, err := asn1.Unmarshal(safe, &contents); err != nil {
+			t.Fatal(err)
+		}
+		bags = append(bags, contents...)
+	}
+	return bags
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain(t, key, time.Hour)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	// The leaf is listed again as part of the chain, but stored once.
+	p12, err := encodePKCS12(keyPEM, append(chain, chain[0]), "tls", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var certs []*x509.Certificate
+	var keys [][]byte
+	for _, bag := range decodePFX(t, p12, "secret") {
+		switch {
+		case bag.ID.Equal(oidCertBag):
+			var cb certBag
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+				t.Fatal(err)
+			}
+			cert, err := x509.ParseCertificate(cb.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs = append(certs, cert)
+		case bag.ID.Equal(oidShroudedKeyBag):
+			k, err := decryptPrivateKey(bag.Value.Bytes, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, k)
+		default:
+			t.Errorf("unexpected bag %s", bag.ID)
+		}
+	}
+
+	if len(certs) != len(chain) {
+		t.Fatalf("got %d certificates, want %d", len(certs), len(chain))
+	}
+	for i := range chain {
+		if !certs[i].Equal(chain[i]) {
+			t.Errorf("certificate %d differs", i)
+		}
+	}
+	want, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0], want) {
+		t.Errorf("got keys %x, want %x", keys, want)
+	}
+}
+
+func TestEncodePKCS12OpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not found")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain(t, key, time.Hour)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	p12, err := encodePKCS12(keyPEM, chain, "tls", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "pkcs12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "keystore.p12")
+	if err := ioutil.WriteFile(file, p12, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(openssl, "pkcs12", "-in", file, "-passin", "pass:secret", "-nodes").Output()
+	if err != nil {
+		t.Fatalf("openssl pkcs12: %s", err)
+	}
+	got, err := parseChain(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(chain) || !got[0].Equal(chain[0]) || !got[1].Equal(chain[1]) {
+		t.Error("openssl read other certificates than were stored")
+	}
+	var keys [][]byte
+	for rest := out; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "PRIVATE KEY" {
+			keys = append(keys, block.Bytes)
+		}
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0], der) {
+		t.Error("openssl read another key than was stored")
+	}
+}
+
+func TestEncodeTruststore(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain(t, key, time.Hour)
+
+	p12, err := encodeTruststore(chain[1:], "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bags := decodePFX(t, p12, "changeit")
+	if len(bags) != 1 {
+		t.Fatalf("got %d bags, want 1", len(bags))
+	}
+	trusted := false
+	for _, a := range bags[0].Attributes {
+		if a.ID.Equal(oidJavaTrustedKeyUsage) {
+			trusted = true
+		}
+	}
+	if !trusted {
+		t.Error("the CA is not marked as trusted")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914, section 11.
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)); got != want {
+		t.Errorf("pbkdf2 = %s, want %s", got, want)
+	}
+}
+
+func TestEncryptKeyPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		key    crypto.Signer
+		format string
+	}{
+		{"rsa pkcs1", rsaKey, "pkcs1"},
+		{"rsa pkcs8", rsaKey, "pkcs8"},
+		{"ecdsa sec1", ecdsaKey, "sec1"},
+		{"ecdsa pkcs8", ecdsaKey, "pkcs8"},
+		{"ed25519 pkcs8", ed25519Key, "pkcs8"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			typ, der, err := marshalPrivateKey(test.key, test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyPEM := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+
+			encrypted, err := encryptKeyPEM(keyPEM, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decryptKeyPEM(encrypted, "wrong"); err == nil {
+				t.Error("decrypting with the wrong passphrase succeeded")
+			}
+			decrypted, err := decryptKeyPEM(encrypted, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block, _ := pem.Decode(decrypted)
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.(crypto.Signer).Public()) {
+				t.Error("decrypted key differs from the encrypted one")
+			}
+		})
+	}
+}
+
+// The fixtures were written with
+//
+//	openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 -out ecdsa.key
+//	openssl pkcs8 -topk8 -in ecdsa.key -v2 aes-256-cbc -v2prf hmacWithSHA256 -iter 2048 -passout pass:fixture -out ecdsa-encrypted.key
+func TestDecryptOpenSSLKey(t *testing.T) {
+	encrypted, err := ioutil.ReadFile("testdata/ecdsa-encrypted.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("testdata/ecdsa.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decryptKeyPEM(encrypted, "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("decrypted key = %q, want %q", got, want)
+	}
+}
+
+func TestEncryptKeyPEMOpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not found")
+	}
+	keyPEM, err := ioutil.ReadFile("testdata/ecdsa.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := encryptKeyPEM(keyPEM, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "pkcs8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "encrypted.key")
+	if err := ioutil.WriteFile(file, encrypted, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(openssl, "pkcs8", "-in", file, "-passin", "pass:secret").Output()
+	if err != nil {
+		t.Fatalf("openssl pkcs8: %s", err)
+	}
+	if !bytes.Equal(out, keyPEM) {
+		t.Errorf("openssl decrypted %q, want %q", out, keyPEM)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// readPodInfo parses a file written by a downward API volume for the
+// metadata.labels or metadata.annotations fields. Each line holds a
+// key="value" pair with the value quoted like a Go string.
+func readPodInfo(dir, name string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, name))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		s := strings.SplitN(line, "=", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: %q", name, line)
+		}
+		value, err := strconv.Unquote(s[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s in %s: %s", s[0], name, err)
+		}
+		info[s[0]] = value
+	}
+	return info, nil
+}
+
+// mapPodInfo copies the entries of info selected by mapping into dst.
+// The mapping is a comma separated list of from=to pairs, where a bare
+// key keeps its name.
+func mapPodInfo(dst, info map[string]string, mapping string) {
+	for _, n := range strings.Split(mapping, ",") {
+		if n == "" {
+			continue
+		}
+		from, to := n, n
+		if s := strings.SplitN(n, "=", 2); len(s) == 2 {
+			from, to = s[0], s[1]
+		}
+		if value, ok := info[from]; ok {
+			dst[to] = value
+		}
+	}
+}
+
+// readNamespaceMetadata returns the labels and annotations of namespace,
+// which needs get on the namespace.
+func readNamespaceMetadata(client *k8s.Client, namespace string) (labels, annotations map[string]string, err error) {
+	ns, err := client.CoreV1().GetNamespace(context.Background(), namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ns.GetMetadata().GetLabels(), ns.GetMetadata().GetAnnotations(), nil
+}
+
+// annotatePod applies update to the annotations of the pod, retrying once
+// should the pod change in the meantime.
+func annotatePod(client *k8s.Client, name, namespace string, update func(annotations map[string]string)) error {
+	for attempt := 0; ; attempt++ {
+		pod, err := client.CoreV1().GetPod(context.Background(), name, namespace)
+		if err != nil {
+			return err
+		}
+		if pod.Metadata.Annotations == nil {
+			pod.Metadata.Annotations = make(map[string]string)
+		}
+		update(pod.Metadata.Annotations)
+
+		_, err = client.CoreV1().UpdatePod(context.Background(), pod)
+		if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusConflict && attempt == 0 {
+			continue
+		}
+		return err
+	}
+}
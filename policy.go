@@ -0,0 +1,131 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// compiledPolicy is a policy baked into the binary, which takes precedence
+// over -policy-configmap. Set it when building a hardened image with
+//
+//	go build -ldflags "-X 'main.compiledPolicy=$(cat policy.json)'"
+var compiledPolicy string
+
+// policyKey is the key of the policy in -policy-configmap.
+const policyKey = "policy.json"
+
+// A policy restricts which namespaces may request certificates for which
+// names from which issuers and signers. A request is allowed if any of the
+// rules allows it.
+type policy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// A policyRule allows requests from namespaces matching one of Namespaces
+// to issuers in Issuers and signers in Signers, for names, DNS names, IP
+// addresses and URIs, that all match one of Names, and a common name, if
+// any, matching one of CommonNames. Patterns use path.Match syntax, an
+// empty list matches anything. Signers only apply to issuers addressing a
+// signer, i.e. the kubernetes one.
+type policyRule struct {
+	Namespaces  []string `json:"namespaces"`
+	Issuers     []string `json:"issuers"`
+	Signers     []string `json:"signers"`
+	Names       []string `json:"names"`
+	CommonNames []string `json:"commonNames"`
+}
+
+func parsePolicy(s string) (*policy, error) {
+	var p policy
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		return nil, err
+	}
+	for _, r := range p.Rules {
+		for _, patterns := range [][]string{r.Namespaces, r.Issuers, r.Signers, r.Names, r.CommonNames} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid pattern %q", pattern)
+				}
+			}
+		}
+	}
+	return &p, nil
+}
+
+// readPolicy reads the policy from a ConfigMap given as namespace/name.
+func readPolicy(client *k8s.Client, configMap string) (*policy, error) {
+	s := strings.SplitN(configMap, "/", 2)
+	if len(s) != 2 {
+		return nil, fmt.Errorf("invalid configmap %q, expected namespace/name", configMap)
+	}
+	cm, err := client.CoreV1().GetConfigMap(context.Background(), s[1], s[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configmap %s: %s", configMap, err)
+	}
+	data, ok := cm.GetData()[policyKey]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s has no %s key", configMap, policyKey)
+	}
+	return parsePolicy(data)
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error unless the policy allows a request from namespace
+// to issuer and signer, if any, for the common name cn, if any, and names.
+func (p *policy) check(namespace, issuer, signer, cn string, names []string) error {
+	for _, r := range p.Rules {
+		if !matchAny(r.Namespaces, namespace) || !matchAny(r.Issuers, issuer) {
+			continue
+		}
+		if signer != "" && !matchAny(r.Signers, signer) {
+			continue
+		}
+		if cn != "" && !matchAny(r.CommonNames, cn) {
+			continue
+		}
+		allowed := true
+		for _, n := range names {
+			if !matchAny(r.Names, n) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return nil
+		}
+	}
+	if cn != "" {
+		names = append([]string{"CN=" + cn}, names...)
+	}
+	if signer != "" {
+		return fmt.Errorf("policy does not allow namespace %s to request %s from the %s issuer with signer %s", namespace, strings.Join(names, ", "), issuer, signer)
+	}
+	return fmt.Errorf("policy does not allow namespace %s to request %s from the %s issuer", namespace, strings.Join(names, ", "), issuer)
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+const testPolicy = `{
+  "rules": [
+    {
+      "namespaces": ["team-a-*"],
+      "issuers": ["kubernetes"],
+      "signers": ["example.com/serving"],
+      "names": ["*.team-a.svc.cluster.local", "10.*"],
+      "commonNames": ["system:serviceaccount:team-a-*"]
+    },
+    {
+      "namespaces": ["ingress"],
+      "issuers": ["cloudflare"],
+      "names": ["*.example.com"]
+    }
+  ]
+}`
+
+func TestPolicyCheck(t *testing.T) {
+	p, err := parsePolicy(testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		namespace string
+		issuer    string
+		signer    string
+		cn        string
+		names     []string
+		allowed   bool
+	}{
+		{"allowed", "team-a-web", "kubernetes", "example.com/serving", "", []string{"web.team-a.svc.cluster.local", "10.0.0.1"}, true},
+		{"no names", "team-a-web", "kubernetes", "example.com/serving", "", nil, true},
+		{"other namespace", "team-b", "kubernetes", "example.com/serving", "", []string{"web.team-a.svc.cluster.local"}, false},
+		{"other issuer", "team-a-web", "cloudflare", "", "", []string{"web.team-a.svc.cluster.local"}, false},
+		{"other signer", "team-a-web", "kubernetes", "kubernetes.io/kube-apiserver-client", "", []string{"web.team-a.svc.cluster.local"}, false},
+		{"other name", "team-a-web", "kubernetes", "example.com/serving", "", []string{"web.team-a.svc.cluster.local", "web.team-b.svc.cluster.local"}, false},
+		{"other IP address", "team-a-web", "kubernetes", "example.com/serving", "", []string{"192.168.0.1"}, false},
+		{"common name", "team-a-web", "kubernetes", "example.com/serving", "system:serviceaccount:team-a-web:default", []string{"web.team-a.svc.cluster.local"}, true},
+		{"other common name", "team-a-web", "kubernetes", "example.com/serving", "system:serviceaccount:team-b:default", []string{"web.team-a.svc.cluster.local"}, false},
+		{"common name only", "team-a-web", "kubernetes", "example.com/serving", "system:masters", nil, false},
+		{"no signer", "ingress", "cloudflare", "", "", []string{"www.example.com"}, true},
+		{"any signer", "ingress", "cloudflare", "example.com/serving", "", []string{"www.example.com"}, true},
+		{"any common name", "ingress", "cloudflare", "", "www.example.com", []string{"www.example.com"}, true},
+		{"second rule names", "ingress", "cloudflare", "", "", []string{"www.example.org"}, false},
+	} {
+		err := p.check(test.namespace, test.issuer, test.signer, test.cn, test.names)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: check(%q, %q, %q, %q, %q) = %v, want allowed %t", test.name, test.namespace, test.issuer, test.signer, test.cn, test.names, err, test.allowed)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, test := range []struct {
+		in string
+		ok bool
+	}{
+		{`{"rules": []}`, true},
+		{`{"rules": [{"names": ["*.example.com"]}]}`, true},
+		{`{"rules": [{"names": ["[a-"]}]}`, false},
+		{`{"rules": [{"signers": ["[a-"]}]}`, false},
+		{`{"rules": [{"commonNames": ["[a-"]}]}`, false},
+		{`{"rules": `, false},
+	} {
+		if _, err := parsePolicy(test.in); (err == nil) != test.ok {
+			t.Errorf("parsePolicy(%s) error = %v, want ok %t", test.in, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+const certificatesGroup = "certificates.k8s.io"
+
+// clusterCapabilities is what the API server supports of the certificates
+// API, as far as this container is concerned.
+type clusterCapabilities struct {
+	Version string `json:"version,omitempty"`
+
+	// CertificatesVersions are the served versions of the certificates
+	// API, preferred first.
+	CertificatesVersions []string `json:"certificatesVersions"`
+
+	// ClusterTrustBundles is the version serving ClusterTrustBundles, if
+	// any.
+	ClusterTrustBundles string `json:"clusterTrustBundles,omitempty"`
+
+	// ExpirationSeconds reports whether requests may ask for a duration,
+	// which API servers ignore before 1.22. It is only known along with
+	// Version.
+	ExpirationSeconds bool `json:"expirationSeconds"`
+
+	// Signers are the signers of the requests visible to the pod, nil if
+	// it may not list them. Only -diagnose lists them, see listSigners.
+	Signers []string `json:"signers,omitempty"`
+}
+
+// serves reports whether version of the certificates API is served.
+func (c *clusterCapabilities) serves(version string) bool {
+	for _, v := range c.CertificatesVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// probeCluster asks the API server what it supports. Anything it can't
+// tell is left unset rather than failing, only the certificates API
+// itself is required.
+func probeCluster(client *k8s.Client) (*clusterCapabilities, error) {
+	caps := new(clusterCapabilities)
+
+	if v, err := client.Discovery().Version(context.Background()); err != nil {
+		log.Printf("unable to get the API server version: %s", err)
+	} else {
+		caps.Version = v.GitVersion
+		major, _ := strconv.Atoi(v.Major)
+		// Managed clusters report minor versions like "22+".
+		minor, _ := strconv.Atoi(strings.TrimRight(v.Minor, "+"))
+		caps.ExpirationSeconds = major > 1 || major == 1 && minor >= 22
+	}
+
+	var group struct {
+		Versions []struct {
+			Version string `json:"version"`
+		} `json:"versions"`
+	}
+	if err := apiJSON(client, "GET", "/apis/"+certificatesGroup, nil, &group); err != nil {
+		return nil, err
+	}
+	for _, v := range group.Versions {
+		caps.CertificatesVersions = append(caps.CertificatesVersions, v.Version)
+
+		var resources struct {
+			Resources []struct {
+				Name string `json:"name"`
+			} `json:"resources"`
+		}
+		if err := apiJSON(client, "GET", "/apis/"+certificatesGroup+"/"+v.Version, nil, &resources); err != nil {
+			continue
+		}
+		for _, r := range resources.Resources {
+			if r.Name == "clustertrustbundles" && caps.ClusterTrustBundles == "" {
+				caps.ClusterTrustBundles = v.Version
+			}
+		}
+	}
+
+	return caps, nil
+}
+
+// listSigners returns the signers of the certificate signing requests
+// visible to the pod, nil if it may not list them, which is common. Only
+// -diagnose asks, listing requests is too expensive for every run.
+func listSigners(client *k8s.Client) []string {
+	var list struct {
+		Items []struct {
+			Spec struct {
+				SignerName string `json:"signerName"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := apiJSON(client, "GET", "/apis/"+certificatesGroup+"/v1/certificatesigningrequests?limit=100", nil, &list); err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	signers := []string{}
+	for _, item := range list.Items {
+		if name := item.Spec.SignerName; name != "" && !seen[name] {
+			seen[name] = true
+			signers = append(signers, name)
+		}
+	}
+	sort.Strings(signers)
+	return signers
+}
+
+// log logs what was found out about the cluster and what it means for
+// the requests of this container.
+func (c *clusterCapabilities) log() {
+	log.Printf("cluster %s serves %s versions %s", c.Version, certificatesGroup, strings.Join(c.CertificatesVersions, ", "))
+	if c.ClusterTrustBundles != "" {
+		log.Printf("cluster serves ClusterTrustBundles in %s/%s", certificatesGroup, c.ClusterTrustBundles)
+	}
+	switch {
+	case c.Version == "":
+		log.Printf("cluster version unknown, expirationSeconds of certificate signing requests may be ignored")
+	case c.ExpirationSeconds:
+		log.Printf("cluster honors expirationSeconds of certificate signing requests")
+	default:
+		log.Printf("cluster ignores expirationSeconds, the signer decides the duration of certificates")
+	}
+}
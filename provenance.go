@@ -0,0 +1,120 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"time"
+)
+
+// version is the version of this binary recorded in provenance documents,
+// set when building with
+//
+//	go build -ldflags "-X main.version=$(git describe --always)"
+var version = "unknown"
+
+// redactedFlags are flags whose values may hold credentials and are left
+// out of provenance documents.
+var redactedFlags = map[string]bool{
+	"exec-issuer-config": true,
+	"pkcs12-password":    true,
+}
+
+// A provenance document records how a certificate was minted: by which
+// build of this container, with which flags, from which issuer and after
+// which approval. It is plain JSON, to be signed with the tooling of the
+// audit pipeline, e.g. cosign sign-blob, where that is required.
+type provenance struct {
+	Builder     provenanceBuilder     `json:"builder"`
+	Time        time.Time             `json:"time"`
+	Pod         string                `json:"pod"`
+	Issuer      string                `json:"issuer"`
+	TrustDomain string                `json:"trustDomain,omitempty"`
+	Request     string                `json:"request"`
+	UID         string                `json:"uid,omitempty"`
+	Approval    string                `json:"approval,omitempty"`
+	Flags       map[string]string     `json:"flags"`
+	Key         provenanceKey         `json:"key"`
+	Certificate provenanceCertificate `json:"certificate"`
+}
+
+// provenanceKey records whether the key was generated for this certificate
+// or kept from an earlier one, see -rekey-every.
+type provenanceKey struct {
+	Rekeyed  bool      `json:"rekeyed"`
+	Created  time.Time `json:"created"`
+	Renewals int       `json:"renewals"`
+}
+
+type provenanceBuilder struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type provenanceCertificate struct {
+	SHA256    string    `json:"sha256"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// marshalProvenance returns the provenance document of c, whose leaf
+// certificate is leaf.
+func marshalProvenance(c *certificate, leaf *x509.Certificate) ([]byte, error) {
+	sum := sha256.Sum256(leaf.Raw)
+	p := provenance{
+		Builder: provenanceBuilder{
+			Name:    "certificate-init-container",
+			Version: version,
+		},
+		Time:        clk.Now().UTC(),
+		Pod:         namespace + "/" + podName,
+		Issuer:      issuerName,
+		TrustDomain: trustDomain,
+		Request:     c.name,
+		UID:         c.uid,
+		Approval:    c.approval,
+		Flags:       make(map[string]string),
+		Key: provenanceKey{
+			Rekeyed:  c.rekeyed,
+			Created:  c.keyCreated.UTC(),
+			Renewals: c.renewals,
+		},
+		Certificate: provenanceCertificate{
+			SHA256:    hex.EncodeToString(sum[:]),
+			Serial:    leaf.SerialNumber.Text(16),
+			Subject:   leaf.Subject.String(),
+			Issuer:    leaf.Issuer.String(),
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+		},
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if redactedFlags[f.Name] {
+			p.Flags[f.Name] = "REDACTED"
+			return
+		}
+		p.Flags[f.Name] = f.Value.String()
+	})
+
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+)
+
+// marshalPublicKeyPEM returns the PEM encoded SubjectPublicKeyInfo of pub.
+func marshalPublicKeyPEM(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// marshalAuthorizedKey returns pub in the OpenSSH authorized_keys format,
+// followed by comment.
+func marshalAuthorizedKey(pub crypto.PublicKey, comment string) ([]byte, error) {
+	var b bytes.Buffer
+	writeString := func(s []byte) {
+		binary.Write(&b, binary.BigEndian, uint32(len(s)))
+		b.Write(s)
+	}
+	writeMPInt := func(n *big.Int) {
+		s := n.Bytes()
+		// A set high bit would make the number negative.
+		if len(s) > 0 && s[0]&0x80 != 0 {
+			s = append([]byte{0}, s...)
+		}
+		writeString(s)
+	}
+
+	var algorithm string
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		algorithm = "ssh-rsa"
+		writeString([]byte(algorithm))
+		writeMPInt(big.NewInt(int64(k.E)))
+		writeMPInt(k.N)
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		algorithm = "ecdsa-sha2-nistp256"
+		writeString([]byte(algorithm))
+		writeString([]byte("nistp256"))
+		writeString(elliptic.Marshal(k.Curve, k.X, k.Y))
+	case ed25519.PublicKey:
+		algorithm = "ssh-ed25519"
+		writeString([]byte(algorithm))
+		writeString(k)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	line := algorithm + " " + base64.StdEncoding.EncodeToString(b.Bytes())
+	if comment != "" {
+		line += " " + comment
+	}
+	return []byte(line + "\n"), nil
+}
+
+// A jwk is a JSON Web Key as defined in RFC 7517.
+type jwk struct {
+	KeyType   string   `json:"kty"`
+	Use       string   `json:"use"`
+	Algorithm string   `json:"alg"`
+	KeyID     string   `json:"kid"`
+	Curve     string   `json:"crv,omitempty"`
+	N         string   `json:"n,omitempty"`
+	E         string   `json:"e,omitempty"`
+	X         string   `json:"x,omitempty"`
+	Y         string   `json:"y,omitempty"`
+	X5C       []string `json:"x5c"`
+	X5TS256   string   `json:"x5t#S256"`
+}
+
+// marshalJWKS returns a JWK Set holding the public key of cert, for
+// services signing JWTs with their TLS key. The key ID is the SHA-256
+// fingerprint of the certificate, which changes with every issuance.
+func marshalJWKS(cert *x509.Certificate) ([]byte, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	key := jwk{
+		Use:     "sig",
+		KeyID:   b64(fingerprint[:]),
+		X5C:     []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+		X5TS256: b64(fingerprint[:]),
+	}
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		key.KeyType = "RSA"
+		key.Algorithm = "RS256"
+		key.N = b64(k.N.Bytes())
+		key.E = b64(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		// Coordinates are padded to the size of the curve.
+		point := elliptic.Marshal(k.Curve, k.X, k.Y)
+		key.KeyType = "EC"
+		key.Algorithm = "ES256"
+		key.Curve = "P-256"
+		key.X = b64(point[1:33])
+		key.Y = b64(point[33:])
+	case ed25519.PublicKey:
+		key.KeyType = "OKP"
+		key.Algorithm = "EdDSA"
+		key.Curve = "Ed25519"
+		key.X = b64(k)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+	}
+
+	return json.MarshalIndent(struct {
+		Keys []jwk `json:"keys"`
+	}{[]jwk{key}}, "", "  ")
+}
@@ -0,0 +1,39 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+)
+
+// randReader is the source of randomness of keys and signatures, the
+// operating system's unless -random-source is set.
+var randReader io.Reader = rand.Reader
+
+// openRandomSource makes the device at path, e.g. /dev/hwrng, the source
+// of randomness, after making sure it delivers.
+func openRandomSource(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(f, b); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to read from %s: %s", path, err)
+	}
+	randReader = f
+	return nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// minRenewalInterval is the least time between renewals, should the
+// certificates issued already be due, and the first delay before retrying
+// failed renewals, doubled with each failure up to maxRenewalBackoff.
+const (
+	minRenewalInterval = 5 * time.Minute
+	maxRenewalBackoff  = time.Hour
+)
+
+// renewalStateAnnotation holds the renewal state with -renewal-state=secret.
+const renewalStateAnnotation = "certificate-init-container/renewal-state"
+
+// A renewalPolicy tells when a certificate is due for renewal: a fraction
+// of its lifetime, or a fixed duration, before it expires.
+type renewalPolicy struct {
+	fraction float64
+	before   time.Duration
+}
+
+// parseRenewalPolicy parses -renew-before, a percentage such as 33% or a
+// duration such as 24h.
+func parseRenewalPolicy(s string) (renewalPolicy, error) {
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return renewalPolicy{}, fmt.Errorf("invalid percentage %q, expected more than 0%% and less than 100%%", s)
+		}
+		return renewalPolicy{fraction: percent / 100}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return renewalPolicy{}, fmt.Errorf("invalid duration %q", s)
+	}
+	return renewalPolicy{before: d}, nil
+}
+
+// nextRenewal returns when the first of the PEM encoded chains is due for
+// renewal.
+func (p renewalPolicy) nextRenewal(chains [][]byte) (time.Time, error) {
+	var next time.Time
+	for _, chain := range chains {
+		certs, err := parseChain(chain)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(certs) == 0 {
+			return time.Time{}, fmt.Errorf("no certificate found")
+		}
+		leaf := certs[0]
+		before := p.before
+		if p.fraction > 0 {
+			before = time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * p.fraction)
+		}
+		if at := leaf.NotAfter.Add(-before); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next, nil
+}
+
+// A rekeyPolicy tells when a renewal generates a new key: every renewals
+// renewals, or once the key is older than age.
+type rekeyPolicy struct {
+	renewals int
+	age      time.Duration
+}
+
+// parseRekeyPolicy parses -rekey-every, a number of renewals such as 3 or
+// a duration such as 720h.
+func parseRekeyPolicy(s string) (rekeyPolicy, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 {
+			return rekeyPolicy{}, fmt.Errorf("invalid number of renewals %d, expected at least 1", n)
+		}
+		return rekeyPolicy{renewals: n}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return rekeyPolicy{}, fmt.Errorf("invalid number of renewals or duration %q", s)
+	}
+	return rekeyPolicy{age: d}, nil
+}
+
+// due tells whether the next renewal of a certificate whose key was
+// generated at created and renewed renewals times since gets a new key.
+func (p rekeyPolicy) due(renewals int, created time.Time) bool {
+	if p.age > 0 {
+		return !clk.Now().Before(created.Add(p.age))
+	}
+	return renewals+1 >= p.renewals
+}
+
+// renewalState is what a restarted sidecar needs to pick up renewals where
+// it left off, see -renewal-state. An attempt is counted as failed until
+// it succeeds, so that one which never returned is also backed off from.
+type renewalState struct {
+	LastIssued  time.Time           `json:"lastIssued,omitempty"`
+	LastAttempt time.Time           `json:"lastAttempt,omitempty"`
+	NextRenewal time.Time           `json:"nextRenewal,omitempty"`
+	Failures    int                 `json:"failures"`
+	Keys        map[string]keyState `json:"keys,omitempty"`
+}
+
+// keyState is the rekey position of a certificate, see -rekey-every.
+type keyState struct {
+	Created  time.Time `json:"created"`
+	Renewals int       `json:"renewals"`
+}
+
+// loadRenewalState reads the renewal state from store, secret for an
+// annotation of -secret-name or a file name. A state not yet saved is
+// empty, as is the state without a store.
+func loadRenewalState(client *k8s.Client, store string) (*renewalState, error) {
+	var b []byte
+	if store == "" {
+		return &renewalState{}, nil
+	} else if store == "secret" {
+		secret, err := client.CoreV1().GetSecret(context.Background(), secretName, namespace)
+		if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusNotFound {
+			return &renewalState{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		b = []byte(secret.GetMetadata().GetAnnotations()[renewalStateAnnotation])
+	} else {
+		var err error
+		b, err = ioutil.ReadFile(store)
+		if os.IsNotExist(err) {
+			return &renewalState{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &renewalState{}
+	if len(b) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("invalid renewal state: %s", err)
+	}
+	return s, nil
+}
+
+// save writes s to store, see loadRenewalState, along with the rekey
+// positions of certs.
+func (s *renewalState) save(client *k8s.Client, store string, certs []*certificate) error {
+	if store == "" {
+		return nil
+	}
+	s.Keys = make(map[string]keyState)
+	for _, c := range certs {
+		if c.key != nil {
+			s.Keys[c.name] = keyState{Created: c.keyCreated.UTC(), Renewals: c.renewals}
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if store != "secret" {
+		return writeFile(store, append(b, '\n'), false)
+	}
+	for attempt := 0; ; attempt++ {
+		secret, err := client.CoreV1().GetSecret(context.Background(), secretName, namespace)
+		if err != nil {
+			return err
+		}
+		if secret.Metadata.Annotations == nil {
+			secret.Metadata.Annotations = make(map[string]string)
+		}
+		secret.Metadata.Annotations[renewalStateAnnotation] = string(b)
+
+		_, err = client.CoreV1().UpdateSecret(context.Background(), secret)
+		if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusConflict && attempt == 0 {
+			continue
+		}
+		return err
+	}
+}
+
+// retryAt returns when a renewal may be attempted again after the failures
+// recorded, the zero time if there are none.
+func (s *renewalState) retryAt() time.Time {
+	if s.Failures == 0 {
+		return time.Time{}
+	}
+	backoff := maxRenewalBackoff
+	if s.Failures < 8 {
+		if d := minRenewalInterval << uint(s.Failures-1); d < backoff {
+			backoff = d
+		}
+	}
+	return s.LastAttempt.Add(backoff)
+}
+
+// restoreKeys sets the rekey positions of certs whose keys are known.
+func (s *renewalState) restoreKeys(certs []*certificate) {
+	for _, c := range certs {
+		if k, ok := s.Keys[c.name]; ok && c.key != nil {
+			c.keyCreated, c.renewals = k.Created, k.Renewals
+		}
+	}
+}
+
+// readIssued returns the chains of certs written to dir by an earlier run
+// and loads their keys, or false unless all of them are there.
+func readIssued(certs []*certificate, dir string) ([][]byte, bool) {
+	var chains [][]byte
+	for _, c := range certs {
+		cert, err := ioutil.ReadFile(path.Join(dir, c.certFile))
+		if err != nil {
+			return nil, false
+		}
+		chain := decodeStoredCert(cert)
+		if c.request == nil {
+			key, err := ioutil.ReadFile(path.Join(dir, c.keyFile))
+			if err != nil {
+				return nil, false
+			}
+			if err := c.loadKey(key, chain); err != nil {
+				return nil, false
+			}
+		}
+		chains = append(chains, chain)
+	}
+	return chains, true
+}
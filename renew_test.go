@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestParseRenewalPolicy(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want renewalPolicy
+		ok   bool
+	}{
+		{"33%", renewalPolicy{fraction: 0.33}, true},
+		{"50.5%", renewalPolicy{fraction: 0.505}, true},
+		{"24h", renewalPolicy{before: 24 * time.Hour}, true},
+		{"0%", renewalPolicy{}, false},
+		{"100%", renewalPolicy{}, false},
+		{"0s", renewalPolicy{}, false},
+		{"-1h", renewalPolicy{}, false},
+		{"soon", renewalPolicy{}, false},
+	} {
+		p, err := parseRenewalPolicy(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("parseRenewalPolicy(%q) error = %v", test.in, err)
+			continue
+		}
+		if p != test.want {
+			t.Errorf("parseRenewalPolicy(%q) = %+v, want %+v", test.in, p, test.want)
+		}
+	}
+}
+
+func TestNextRenewal(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := testChain(t, key, 24*time.Hour)
+	hour := testChain(t, key, time.Hour)
+
+	for _, test := range []struct {
+		name   string
+		policy renewalPolicy
+		chains [][]byte
+		want   time.Time
+	}{
+		{"fraction", renewalPolicy{fraction: 0.25}, [][]byte{encodeChain(day)}, day[0].NotAfter.Add(-6 * time.Hour)},
+		{"duration", renewalPolicy{before: 2 * time.Hour}, [][]byte{encodeChain(day)}, day[0].NotAfter.Add(-2 * time.Hour)},
+		{"first due", renewalPolicy{before: 30 * time.Minute}, [][]byte{encodeChain(day), encodeChain(hour)}, hour[0].NotAfter.Add(-30 * time.Minute)},
+		{"leaf only", renewalPolicy{fraction: 0.5}, [][]byte{encodeChain(hour[:1])}, hour[0].NotAfter.Add(-30 * time.Minute)},
+		{"due already", renewalPolicy{before: 2 * time.Hour}, [][]byte{encodeChain(hour)}, hour[0].NotAfter.Add(-2 * time.Hour)},
+	} {
+		next, err := test.policy.nextRenewal(test.chains)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !next.Equal(test.want) {
+			t.Errorf("%s: next renewal at %s, want %s", test.name, next, test.want)
+		}
+	}
+
+	if _, err := (renewalPolicy{fraction: 0.5}).nextRenewal([][]byte{[]byte("not a certificate")}); err == nil {
+		t.Error("nextRenewal of no certificate succeeded")
+	}
+}
+
+func TestRekeyPolicy(t *testing.T) {
+	now := clk.Now()
+	for _, test := range []struct {
+		policy   string
+		renewals int
+		created  time.Time
+		due      bool
+	}{
+		{"1", 0, now, true},
+		{"3", 0, now, false},
+		{"3", 1, now, false},
+		{"3", 2, now, true},
+		{"720h", 5, now.Add(-time.Hour), false},
+		{"720h", 0, now.Add(-721 * time.Hour), true},
+	} {
+		p, err := parseRekeyPolicy(test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if due := p.due(test.renewals, test.created); due != test.due {
+			t.Errorf("-rekey-every=%s after %d renewals of a key created %s ago: due = %t, want %t", test.policy, test.renewals, now.Sub(test.created), due, test.due)
+		}
+	}
+
+	for _, s := range []string{"0", "-1", "0s", "often"} {
+		if _, err := parseRekeyPolicy(s); err == nil {
+			t.Errorf("parseRekeyPolicy(%q) succeeded", s)
+		}
+	}
+}
+
+func TestRetryAt(t *testing.T) {
+	last := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		failures int
+		want     time.Time
+	}{
+		{0, time.Time{}},
+		{1, last.Add(minRenewalInterval)},
+		{2, last.Add(2 * minRenewalInterval)},
+		{4, last.Add(8 * minRenewalInterval)},
+		{5, last.Add(maxRenewalBackoff)},
+		{100, last.Add(maxRenewalBackoff)},
+	} {
+		s := &renewalState{LastAttempt: last, Failures: test.failures}
+		if got := s.retryAt(); !got.Equal(test.want) {
+			t.Errorf("retryAt after %d failures = %s, want %s", test.failures, got, test.want)
+		}
+	}
+}
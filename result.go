@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+)
+
+// The values of -partial-failure-policy, what to do when some of several
+// certificates can't be obtained:
+//   - fail stops at the first failure and stores nothing.
+//   - continue requests all of them, stores those issued and then fails.
+//   - best-effort requests all of them, stores those issued and succeeds
+//     if any was issued.
+const (
+	partialFailureFail       = "fail"
+	partialFailureContinue   = "continue"
+	partialFailureBestEffort = "best-effort"
+)
+
+// An issuanceResult summarizes which certificates were issued.
+type issuanceResult struct {
+	Policy       string              `json:"policy"`
+	Certificates []certificateResult `json:"certificates"`
+}
+
+type certificateResult struct {
+	Name   string `json:"name"`
+	Issued bool   `json:"issued"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (r *issuanceResult) add(c *certificate, err error) {
+	cr := certificateResult{Name: c.name, Issued: err == nil}
+	if err != nil {
+		cr.Error = err.Error()
+	}
+	r.Certificates = append(r.Certificates, cr)
+}
+
+// failed returns the number of certificates that were not issued.
+func (r *issuanceResult) failed() int {
+	n := 0
+	for _, c := range r.Certificates {
+		if !c.Issued {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *issuanceResult) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
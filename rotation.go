@@ -0,0 +1,76 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/ericchiang/k8s"
+)
+
+// readRotationCAs reads the CA bundles of -rotation-cas, ordered from the
+// CA being retired to the one the signer switches to. Unlike federated
+// bundles every one of them is required: leaving one out could make
+// clients reject certificates in the middle of the rotation.
+func readRotationCAs(client *k8s.Client, sources []string) ([][]byte, error) {
+	var bundles [][]byte
+	for _, source := range sources {
+		bundle, err := fetchBundle(client, source)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA bundle of %s: %s", source, err)
+		}
+		bundles = append(bundles, bundle)
+	}
+	return bundles, nil
+}
+
+// rotationDue tells whether the certificates have to be issued anew
+// because of a CA rotation: the rotation bundles differ from the written
+// ones, or one of the PEM encoded chains is not signed by the newest CA.
+func rotationDue(chains [][]byte, bundles [][]byte, written []byte) (bool, error) {
+	if len(bundles) == 0 {
+		return false, nil
+	}
+	if !bytes.Equal(mergeBundles(bundles...), written) {
+		return true, nil
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundles[len(bundles)-1]) {
+		return false, fmt.Errorf("no certificates found in the newest CA bundle")
+	}
+	for _, chain := range chains {
+		certs, err := parseChain(chain)
+		if err != nil {
+			return false, err
+		}
+		if len(certs) == 0 {
+			return false, fmt.Errorf("no certificate found")
+		}
+		intermediates := x509.NewCertPool()
+		for _, ic := range certs[1:] {
+			intermediates.AddCert(ic)
+		}
+		_, err = certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   clk.Now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// An otherName is a subject alternative name of a type crypto/x509 has no
+// support for, e.g. a Microsoft UPN (1.3.6.1.4.1.311.20.2.3), with a UTF-8
+// string value.
+type otherName struct {
+	oid   asn1.ObjectIdentifier
+	value string
+}
+
+func (n otherName) String() string {
+	return n.oid.String() + "=" + n.value
+}
+
+// parseOtherName parses an otherName given as OID=value.
+func parseOtherName(s string) (otherName, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return otherName{}, fmt.Errorf("invalid other name %q, expected OID=value", s)
+	}
+	oid, ok := parseOID(kv[0])
+	if !ok {
+		return otherName{}, fmt.Errorf("invalid other name %q, %q is not an OID", s, kv[0])
+	}
+	return otherName{oid: oid, value: kv[1]}, nil
+}
+
+// The context specific tags of the GeneralName choices, RFC 5280 4.2.1.6.
+const (
+	nameTypeOther = 0
+	nameTypeDNS   = 2
+	nameTypeURI   = 6
+	nameTypeIP    = 7
+)
+
+// subjectAltNameExtension encodes the subject alternative name extension
+// holding all of the given names. crypto/x509 leaves out its own when the
+// request template carries this one, so it has to include every name.
+func subjectAltNameExtension(dnsNames []string, ipAddresses []net.IP, uris []*url.URL, otherNames []otherName) (pkix.Extension, error) {
+	var names []asn1.RawValue
+	for _, n := range otherNames {
+		value, err := asn1.MarshalWithParams(n.value, "utf8")
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		// OtherName ::= SEQUENCE { type-id OID, value [0] EXPLICIT ANY }
+		b, err := asn1.Marshal(n.oid)
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		explicit, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value})
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: nameTypeOther, IsCompound: true, Bytes: append(b, explicit...)})
+	}
+	for _, n := range dnsNames {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: nameTypeDNS, Bytes: []byte(n)})
+	}
+	for _, ip := range ipAddresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: nameTypeIP, Bytes: ip})
+	}
+	for _, u := range uris {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: nameTypeURI, Bytes: []byte(u.String())})
+	}
+
+	value, err := asn1.Marshal(names)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidSubjectAltName, Value: value}, nil
+}
+
+// parseSANOrder parses the comma separated patterns of -san-order.
+func parseSANOrder(s string) ([]string, error) {
+	patterns := strings.Split(s, ",")
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// orderNames sorts names by the first of patterns they match, in path.Match
+// syntax, leaving those that match none last. Names matching the same
+// pattern keep their order. Some clients only look at the first name.
+func orderNames(names, patterns []string) []string {
+	rank := func(n string) int {
+		for i, pattern := range patterns {
+			if ok, _ := path.Match(pattern, n); ok {
+				return i
+			}
+		}
+		return len(patterns)
+	}
+	ordered := append([]string(nil), names...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rank(ordered[i]) < rank(ordered[j])
+	})
+	return ordered
+}
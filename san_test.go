@@ -0,0 +1,121 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSubjectAltNameExtension(t *testing.T) {
+	dnsNames := []string{"tls-app.default.svc.cluster.local"}
+	ipAddresses := []net.IP{net.ParseIP("10.0.0.1").To4(), net.ParseIP("fd00::1")}
+	uri, err := url.Parse("spiffe://cluster.local/ns/default/sa/tls-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upn, err := parseOtherName("1.3.6.1.4.1.311.20.2.3=tls-app@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ext, err := subjectAltNameExtension(dnsNames, ipAddresses, []*url.URL{uri}, []otherName{upn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:         pkix.Name{CommonName: "tls-app"},
+		ExtraExtensions: []pkix.Extension{ext},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crypto/x509 parses the names it knows and skips the others.
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(csr.DNSNames, dnsNames) {
+		t.Errorf("DNS names = %v, want %v", csr.DNSNames, dnsNames)
+	}
+	if !reflect.DeepEqual(csr.IPAddresses, ipAddresses) {
+		t.Errorf("IP addresses = %v, want %v", csr.IPAddresses, ipAddresses)
+	}
+	if len(csr.URIs) != 1 || csr.URIs[0].String() != uri.String() {
+		t.Errorf("URIs = %v, want %v", csr.URIs, uri)
+	}
+
+	var others []otherName
+	for _, e := range csr.Extensions {
+		if !e.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(e.Value, &names); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range names {
+			if n.Class != asn1.ClassContextSpecific || n.Tag != nameTypeOther {
+				continue
+			}
+			var oid asn1.ObjectIdentifier
+			rest, err := asn1.Unmarshal(n.Bytes, &oid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var value string
+			if _, err := asn1.UnmarshalWithParams(rest, &value, "explicit,tag:0,utf8"); err != nil {
+				t.Fatal(err)
+			}
+			others = append(others, otherName{oid: oid, value: value})
+		}
+	}
+	if !reflect.DeepEqual(others, []otherName{upn}) {
+		t.Errorf("other names = %v, want %v", others, upn)
+	}
+}
+
+func TestParseOtherName(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"1.3.6.1.4.1.311.20.2.3=user@example.com", "1.3.6.1.4.1.311.20.2.3=user@example.com", true},
+		{"1.3.6.1.4.1.311.20.2.3=a=b", "1.3.6.1.4.1.311.20.2.3=a=b", true},
+		{"1.3.6.1.4.1.311.20.2.3=", "", false},
+		{"upn=user@example.com", "", false},
+		{"user@example.com", "", false},
+	} {
+		n, err := parseOtherName(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("parseOtherName(%q) error = %v", test.in, err)
+			continue
+		}
+		if test.ok && n.String() != test.want {
+			t.Errorf("parseOtherName(%q) = %s, want %s", test.in, n, test.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	apiv1 "github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+// newSecret returns the secret name for writeSecret to create, with the
+// labels and annotations of -secret-labels and -secret-annotations. It is
+// a kubernetes.io/tls secret if it will hold tls.key and tls.crt.
+func newSecret(name string, tlsType bool) (*apiv1.Secret, error) {
+	labels, err := parseKeyValues(secretLabels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -secret-labels: %s", err)
+	}
+	annotations, err := parseKeyValues(secretAnnotations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -secret-annotations: %s", err)
+	}
+	typ := "Opaque"
+	if tlsType {
+		typ = "kubernetes.io/tls"
+	}
+	return &apiv1.Secret{
+		Metadata: &v1.ObjectMeta{
+			Name:        k8s.String(name),
+			Namespace:   k8s.String(namespace),
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Type: k8s.String(typ),
+	}, nil
+}
+
+// parseKeyValues parses a comma separated list of key=value pairs.
+func parseKeyValues(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected key=value", kv)
+		}
+		m[p[0]] = p[1]
+	}
+	return m, nil
+}
+
+// writeSecret stores the keys and certificates of certs along with the CA
+// as caFile in secret, and records audit in its annotations if enabled. A
+// secret that was not read from the API server is created.
+func writeSecret(client *k8s.Client, secret *apiv1.Secret, certs []*certificate, caFile string, ca []byte, audit []*auditEntry) error {
+	// Superseded credentials stay around for a while, giving consumers
+	// a short window to roll back.
+	if secretVersions > 0 {
+		var keys []string
+		for _, c := range certs {
+			keys = append(keys, c.keyFile, c.certFile)
+			for name := range c.outputs {
+				keys = append(keys, name)
+			}
+		}
+		keepSecretVersions(secret.Data, append(keys, caFile), secretVersions)
+	}
+
+	// Derived outputs may be binary, e.g. DER encoded, and so may be the
+	// key and certificate with -encoding=der.
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	stringData := make(map[string]string)
+	for _, c := range certs {
+		// The key of a request generated elsewhere stays with its holder,
+		// a key left from before would not match the certificate.
+		if c.request != nil {
+			delete(secret.Data, c.keyFile)
+		} else if derEncoding {
+			secret.Data[c.keyFile] = encodeStored(c.atRest)
+		} else {
+			stringData[c.keyFile] = string(c.atRest)
+		}
+		if derEncoding {
+			secret.Data[c.certFile] = encodeStored(c.certOut)
+		} else {
+			stringData[c.certFile] = string(c.certOut)
+		}
+	}
+	stringData[caFile] = string(ca) // ok
+	if rotatePKCS12 {
+		stringData[keystorePasswordKey] = keystorePassword
+		if previousPassword != "" {
+			stringData[previousPasswordKey] = previousPassword
+		} else {
+			delete(secret.Data, previousPasswordKey)
+		}
+	}
+
+	for _, c := range certs {
+		for name, data := range c.outputs {
+			secret.Data[name] = data
+		}
+	}
+
+	secret.StringData = stringData
+
+	if secret.Metadata.Annotations == nil {
+		secret.Metadata.Annotations = make(map[string]string)
+	}
+	for k, v := range nsAnnotations {
+		secret.Metadata.Annotations[k] = v
+	}
+	if len(nsLabels) > 0 && secret.Metadata.Labels == nil {
+		secret.Metadata.Labels = make(map[string]string)
+	}
+	for k, v := range nsLabels {
+		secret.Metadata.Labels[k] = v
+	}
+	if latencyAnnotations {
+		setLatencyAnnotations(secret.Metadata.Annotations, certs)
+	}
+	if auditHistory > 0 {
+		if err := appendAuditAnnotation(secret.Metadata.Annotations, audit, auditHistory); err != nil {
+			return fmt.Errorf("unable to record the issuance in secret %s: %s", secret.Metadata.GetName(), err)
+		}
+	}
+
+	// The request carries the private key, make sure it doesn't end up in
+	// the logs should the API server echo the request in its error.
+	var err error
+	if secret.Metadata.GetResourceVersion() == "" {
+		_, err = client.CoreV1().CreateSecret(context.TODO(), secret)
+	} else {
+		_, err = client.CoreV1().UpdateSecret(context.TODO(), secret)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to store credentials in secret %s: %s", secret.Metadata.GetName(), redact([]byte(err.Error())))
+	}
+	return nil
+}
+
+// keepSecretVersions moves the current value of each of keys in data to
+// key.1, the previous key.1 to key.2 and so on, keeping no more than n
+// previous versions of each key. Older versions are removed.
+func keepSecretVersions(data map[string][]byte, keys []string, n int) {
+	version := func(key string, i int) string {
+		if i == 0 {
+			return key
+		}
+		return fmt.Sprintf("%s.%d", key, i)
+	}
+
+	for _, key := range keys {
+		// Versions beyond n may be left after gaps, e.g. once n was
+		// lowered, so look at every suffixed key rather than counting up.
+		for k := range data {
+			if !strings.HasPrefix(k, key+".") {
+				continue
+			}
+			if i, err := strconv.Atoi(strings.TrimPrefix(k, key+".")); err == nil && i > n {
+				delete(data, k)
+			}
+		}
+		for i := n; i > 0; i-- {
+			if v, ok := data[version(key, i-1)]; ok {
+				data[version(key, i)] = v
+			} else {
+				delete(data, version(key, i))
+			}
+		}
+	}
+}
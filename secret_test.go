@@ -0,0 +1,70 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeepSecretVersions(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		in   map[string]string
+		n    int
+		want map[string]string
+	}{
+		{
+			"first version",
+			map[string]string{"tls.crt": "a"},
+			2,
+			map[string]string{"tls.crt": "a", "tls.crt.1": "a"},
+		},
+		{
+			"oldest dropped",
+			map[string]string{"tls.crt": "c", "tls.crt.1": "b", "tls.crt.2": "a"},
+			2,
+			map[string]string{"tls.crt": "c", "tls.crt.1": "c", "tls.crt.2": "b"},
+		},
+		{
+			"lowered limit",
+			map[string]string{"tls.crt": "e", "tls.crt.1": "d", "tls.crt.2": "c", "tls.crt.3": "b", "tls.crt.4": "a"},
+			1,
+			map[string]string{"tls.crt": "e", "tls.crt.1": "e"},
+		},
+		{
+			"gap",
+			map[string]string{"tls.crt": "c", "tls.crt.2": "b", "tls.crt.5": "a"},
+			2,
+			map[string]string{"tls.crt": "c", "tls.crt.1": "c"},
+		},
+		{
+			"other keys",
+			map[string]string{"tls.crt": "b", "tls.crt.1": "a", "tls.crt.sha256": "x", "ca.crt.3": "y"},
+			1,
+			map[string]string{"tls.crt": "b", "tls.crt.1": "b", "tls.crt.sha256": "x", "ca.crt.3": "y"},
+		},
+	} {
+		data := make(map[string][]byte)
+		for k, v := range test.in {
+			data[k] = []byte(v)
+		}
+		keepSecretVersions(data, []string{"tls.crt"}, test.n)
+		got := make(map[string]string)
+		for k, v := range data {
+			got[k] = string(v)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// caRefreshInterval is how long the CA served by -serve-ca is cached.
+const caRefreshInterval = time.Minute
+
+// Peers only ever fetch a small file, slow or idle connections are cut
+// rather than held open.
+const (
+	caTimeout     = 10 * time.Second
+	caIdleTimeout = time.Minute
+)
+
+// caServer serves the current CA of an issuer, and only the CA, to peers
+// bootstrapping their trust in it.
+type caServer struct {
+	iss issuer
+
+	mu      sync.Mutex
+	ca      []byte
+	fetched time.Time
+}
+
+// serveCA serves the CA of iss as /ca.crt on addr, e.g. 127.0.0.1:8080 for
+// the pod itself or :8080 for its peers too, until the server fails.
+func serveCA(addr string, iss issuer) error {
+	mux := http.NewServeMux()
+	mux.Handle("/ca.crt", &caServer{iss: iss})
+	log.Printf("serving the CA on http://%s/ca.crt", addr)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: caTimeout,
+		ReadTimeout:       caTimeout,
+		WriteTimeout:      caTimeout,
+		IdleTimeout:       caIdleTimeout,
+	}
+	return server.ListenAndServe()
+}
+
+func (s *caServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ca, err := s.current()
+	if err != nil {
+		log.Printf("unable to get the CA: %s", err)
+		http.Error(w, "CA unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(ca)
+}
+
+// current returns the CA, asking the issuer again once the cached one is
+// older than caRefreshInterval. The last known CA is served should the
+// issuer fail meanwhile.
+func (s *caServer) current() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ca != nil && since(s.fetched) < caRefreshInterval {
+		return s.ca, nil
+	}
+	ca, err := s.iss.CA()
+	if err != nil {
+		if s.ca != nil {
+			return s.ca, nil
+		}
+		return nil, err
+	}
+	s.ca, s.fetched = ca, clk.Now()
+	return ca, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// serviceAccountUsername returns the username the pod's service account
+// authenticates as, system:serviceaccount:<namespace>:<name>. The name is
+// taken from the subject of the service account token if not given.
+func serviceAccountUsername(name, namespace string) (string, error) {
+	if name != "" {
+		return fmt.Sprintf("system:serviceaccount:%s:%s", namespace, name), nil
+	}
+
+	token, err := ioutil.ReadFile(apiTokenFile)
+	if err != nil {
+		return "", err
+	}
+	// The token is only read for its claims, the API server verifies it.
+	parts := strings.Split(strings.TrimSpace(string(token)), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%s is not a JWT", apiTokenFile)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("unable to decode %s: %s", apiTokenFile, err)
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("unable to decode %s: %s", apiTokenFile, err)
+	}
+	if !strings.HasPrefix(claims.Subject, "system:serviceaccount:") {
+		return "", fmt.Errorf("%s is not a service account token", apiTokenFile)
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ericchiang/k8s"
+)
+
+// includeAnnotation marks a Service whose name is to be included in the
+// certificates of the pods it selects, with -annotated-services.
+const includeAnnotation = "cert-init.lalamove.com/include"
+
+// annotatedServices returns the names of the Services in namespace that
+// are annotated with includeAnnotation=true and select a pod with labels.
+func annotatedServices(client *k8s.Client, namespace string, labels map[string]string) ([]string, error) {
+	list, err := client.CoreV1().ListServices(context.Background(), namespace)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, svc := range list.GetItems() {
+		if svc.GetMetadata().GetAnnotations()[includeAnnotation] != "true" {
+			continue
+		}
+		// A Service without a selector has its endpoints managed by
+		// hand, there is no telling which pods it reaches.
+		selector := svc.GetSpec().GetSelector()
+		if len(selector) == 0 {
+			continue
+		}
+		if selects(selector, labels) {
+			names = append(names, svc.GetMetadata().GetName())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func selects(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// readPodLabels returns the labels of the pod, from the downward API volume
+// if there is one, from the API otherwise.
+func readPodLabels(client *k8s.Client, name, namespace string) (map[string]string, error) {
+	if podInfoDir != "" {
+		return readPodInfo(podInfoDir, "labels")
+	}
+	pod, err := client.CoreV1().GetPod(context.Background(), name, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return pod.GetMetadata().GetLabels(), nil
+}
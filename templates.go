@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// An outputTemplate is a -template file, rendered with a templateData
+// into the file or secret key name.
+type outputTemplate struct {
+	name string
+	tmpl *template.Template
+}
+
+// templateData is what -template files are rendered with, e.g.
+// {{range .Certificates}}crt {{.CertFile}}{{end}}.
+type templateData struct {
+	// Dir is the directory the files are written to, empty with
+	// -secret-name. CAFile is the key of the CA in the secret, no CA
+	// file is written to Dir.
+	Dir          string
+	CAFile       string
+	Certificates []templateCertificate
+}
+
+// A templateCertificate describes an issued certificate. KeyFile and
+// CertFile are paths in Dir, or keys of the secret.
+type templateCertificate struct {
+	Name     string
+	KeyFile  string
+	CertFile string
+
+	// Fingerprint is the hex encoded SHA-256 digest of the certificate,
+	// SPKIPin the base64 encoded one of its subject public key info.
+	Fingerprint string
+	SPKIPin     string
+
+	Serial      string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	DNSNames    []string
+	IPAddresses []string
+	URIs        []string
+}
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// parseOutputTemplates reads the templates of -template, each
+// template=name, comma separated.
+func parseOutputTemplates(spec string) ([]outputTemplate, error) {
+	var templates []outputTemplate
+	var names []string
+	for _, s := range strings.Split(spec, ",") {
+		if s == "" {
+			continue
+		}
+		i := strings.LastIndex(s, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid template %q, expected template=name", s)
+		}
+		file, name := s[:i], s[i+1:]
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(path.Base(file)).Funcs(templateFuncs).Option("missingkey=error").Parse(string(b))
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, outputTemplate{name: name, tmpl: tmpl})
+		names = append(names, name)
+	}
+	if err := checkFileNames(names...); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// renderTemplates renders templates for the issued certs, whose files are
+// in dir, if set, and returns the results by name.
+func renderTemplates(templates []outputTemplate, certs []*certificate, dir string) (map[string][]byte, error) {
+	file := func(name string) string {
+		if dir == "" {
+			return name
+		}
+		return path.Join(dir, name)
+	}
+	data := templateData{Dir: dir}
+	if dir == "" {
+		data.CAFile = caFileName
+	}
+	for _, c := range certs {
+		chain, err := parseChain(c.cert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the certificate for %s: %s", c.name, err)
+		}
+		if len(chain) == 0 {
+			return nil, fmt.Errorf("no certificate found for %s", c.name)
+		}
+		leaf := chain[0]
+		sum := sha256.Sum256(leaf.Raw)
+		pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		tc := templateCertificate{
+			Name:        c.name,
+			KeyFile:     file(c.keyFile),
+			CertFile:    file(c.certFile),
+			Fingerprint: hex.EncodeToString(sum[:]),
+			SPKIPin:     base64.StdEncoding.EncodeToString(pin[:]),
+			Serial:      leaf.SerialNumber.String(),
+			NotBefore:   leaf.NotBefore,
+			NotAfter:    leaf.NotAfter,
+			DNSNames:    leaf.DNSNames,
+		}
+		for _, ip := range leaf.IPAddresses {
+			tc.IPAddresses = append(tc.IPAddresses, ip.String())
+		}
+		for _, u := range leaf.URIs {
+			tc.URIs = append(tc.URIs, u.String())
+		}
+		data.Certificates = append(data.Certificates, tc)
+	}
+
+	outputs := make(map[string][]byte)
+	for _, t := range templates {
+		var b bytes.Buffer
+		if err := t.tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("unable to render %s: %s", t.name, err)
+		}
+		outputs[t.name] = b.Bytes()
+	}
+	return outputs, nil
+}
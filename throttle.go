@@ -0,0 +1,55 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// throttleSchedule is when a waiting loop logs, relative to the start of
+// the wait. After the last entry it logs every throttleInterval.
+var (
+	throttleSchedule = []time.Duration{0, 30 * time.Second, 2 * time.Minute}
+	throttleInterval = 10 * time.Minute
+)
+
+// A logThrottle logs the state of a wait loop progressively less often,
+// so a fleet of pods waiting on approval doesn't flood the log pipeline.
+type logThrottle struct {
+	start time.Time
+	n     int
+}
+
+func newLogThrottle() *logThrottle {
+	return &logThrottle{start: clk.Now()}
+}
+
+// Printf logs the message along with the time waited so far, if it is
+// time to log again.
+func (t *logThrottle) Printf(format string, v ...interface{}) {
+	elapsed := since(t.start)
+
+	next := throttleInterval * time.Duration(t.n-len(throttleSchedule)+1)
+	if t.n < len(throttleSchedule) {
+		next = throttleSchedule[t.n]
+	} else {
+		next += throttleSchedule[len(throttleSchedule)-1]
+	}
+	if elapsed < next {
+		return
+	}
+	t.n++
+
+	log.Printf("%s (waiting for %s)", fmt.Sprintf(format, v...), elapsed-elapsed%time.Second)
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var privateKeyPEM = regexp.MustCompile(`-----BEGIN ([A-Z0-9 ]*)PRIVATE KEY-----[\s\S]*?-----END ([A-Z0-9 ]*)PRIVATE KEY-----`)
+
+// redact replaces the contents of every PEM encoded private key in b.
+func redact(b []byte) []byte {
+	return privateKeyPEM.ReplaceAll(b, []byte("-----BEGIN ${1}PRIVATE KEY-----REDACTED-----END ${2}PRIVATE KEY-----"))
+}
+
+// debugTransport logs the method, URL and body of every request and the
+// status and body of every response. Headers, which carry the bearer token,
+// are never logged and private keys are redacted from the bodies. Bodies
+// of secrets are left out altogether: keys in them may be DER encoded, or
+// base64 encoded under data, where no pattern finds them.
+type debugTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	secret := isSecretPath(req.URL.Path)
+	if secret {
+		log.Printf("> %s %s (secret, %d bytes)", req.Method, req.URL, len(body))
+	} else {
+		log.Printf("> %s %s %q", req.Method, req.URL, redact(body))
+	}
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		log.Printf("< %s %s: %s", req.Method, req.URL, err)
+		return nil, err
+	}
+
+	// Watches stream until they time out, reading them here would hold
+	// back every event until then.
+	if req.URL.Query().Get("watch") != "" {
+		log.Printf("< %s %s (streaming)", req.URL, resp.Status)
+		return resp, nil
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if secret {
+		log.Printf("< %s %s (secret, %d bytes)", req.URL, resp.Status, len(body))
+	} else {
+		log.Printf("< %s %s %q", req.URL, resp.Status, redact(body))
+	}
+	return resp, nil
+}
+
+// isSecretPath tells whether path is that of secrets or a secret, e.g.
+// /api/v1/namespaces/default/secrets/tls.
+func isSecretPath(path string) bool {
+	s := strings.Split(strings.Trim(path, "/"), "/")
+	for i, p := range s {
+		if p == "secrets" && i > 0 && (s[i-1] == "v1" || i > 1 && s[i-2] == "namespaces") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// updateTrustBundle adds ca to the PEM trust bundle in file, typically on a
+// hostPath volume read by node agents, between markers naming the issuer.
+// A block written before is replaced, the rest of the bundle is kept as is.
+// Pods on the same node serialize on file.lock and the bundle is replaced
+// by a rename, so its readers never see a partial file.
+func updateTrustBundle(file string, ca []byte, issuer string) error {
+	lock, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("unable to lock %s: %s", lock.Name(), err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	mode := os.FileMode(0644)
+	bundle, err := ioutil.ReadFile(file)
+	switch {
+	case err == nil:
+		if fi, err := os.Stat(file); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	case os.IsNotExist(err):
+	default:
+		return err
+	}
+
+	begin := []byte(fmt.Sprintf("# BEGIN certificate-init-container %s CA\n", issuer))
+	end := []byte(fmt.Sprintf("# END certificate-init-container %s CA\n", issuer))
+	if i := bytes.Index(bundle, begin); i >= 0 {
+		if j := bytes.Index(bundle[i:], end); j >= 0 {
+			bundle = append(bundle[:i:i], bundle[i+j+len(end):]...)
+		}
+	}
+	if len(bundle) > 0 && !bytes.HasSuffix(bundle, []byte("\n")) {
+		bundle = append(bundle, '\n')
+	}
+	bundle = append(bundle, begin...)
+	bundle = append(bundle, bytes.TrimSpace(ca)...)
+	bundle = append(bundle, '\n')
+	bundle = append(bundle, end...)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bundle); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
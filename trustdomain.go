@@ -0,0 +1,67 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// trustDomainLabel is the label of certificate signing requests naming
+// the trust domain of -trust-domain they belong to.
+const trustDomainLabel = "certificate-init-container/trust-domain"
+
+// readTrustBundle reads the CA bundle of trustDomain from a ConfigMap given
+// as namespace/name, which holds one bundle per trust domain keyed by the
+// trust domain.
+func readTrustBundle(client *k8s.Client, configMap, trustDomain string) ([]byte, error) {
+	s := strings.SplitN(configMap, "/", 2)
+	if len(s) != 2 {
+		return nil, fmt.Errorf("invalid configmap %q, expected namespace/name", configMap)
+	}
+	cm, err := client.CoreV1().GetConfigMap(context.Background(), s[1], s[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configmap %s: %s", configMap, err)
+	}
+	bundle, ok := cm.GetData()[trustDomain]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s has no bundle for trust domain %s", configMap, trustDomain)
+	}
+	if _, err := parseChain([]byte(bundle)); err != nil {
+		return nil, fmt.Errorf("configmap %s: bundle of trust domain %s: %s", configMap, trustDomain, err)
+	}
+	return []byte(bundle), nil
+}
+
+// trustBundleIssuer hands out the CA bundle of a trust domain as the CA of
+// the issuer it wraps, which is what certificates are checked against and
+// what is stored as ca.crt.
+type trustBundleIssuer struct {
+	issuer
+	ca []byte
+}
+
+// withTrustBundle wraps iss to use ca as its CA, or returns it as is if ca
+// is nil.
+func withTrustBundle(iss issuer, ca []byte) issuer {
+	if ca == nil {
+		return iss
+	}
+	return &trustBundleIssuer{issuer: iss, ca: ca}
+}
+
+func (i *trustBundleIssuer) CA() ([]byte, error) {
+	return i.ca, nil
+}
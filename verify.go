@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// verifyCertificate checks that previously issued material for c is usable:
+// the key matches the certificate, the certificate is currently valid,
+// covers the names c would request and chains up to ca. Names in podNames,
+// the IP address and DNS names of the pod, are not checked: a secret shared
+// by the replicas of a deployment carries those of the pod that created it.
+func verifyCertificate(c *certificate, key, cert, ca []byte, podNames map[string]bool) error {
+	var chain []*x509.Certificate
+	if c.request != nil {
+		// The key is held elsewhere, the certificate has to match the
+		// request instead.
+		if err := matchesRequest(cert, c.request); err != nil {
+			return fmt.Errorf("%s does not match the certificate request: %s", c.certFile, err)
+		}
+		var err error
+		if chain, err = parseChain(cert); err != nil {
+			return fmt.Errorf("unable to parse %s: %s", c.certFile, err)
+		}
+	} else {
+		if keyPassphrase != "" {
+			var err error
+			if key, err = decryptKeyPEM(key, keyPassphrase); err != nil {
+				return fmt.Errorf("unable to decrypt %s: %s", c.keyFile, err)
+			}
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return fmt.Errorf("%s does not match %s: %s", c.certFile, c.keyFile, err)
+		}
+		for _, der := range pair.Certificate {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return fmt.Errorf("unable to parse %s: %s", c.certFile, err)
+			}
+			chain = append(chain, cert)
+		}
+	}
+	leaf := chain[0]
+
+	now := clk.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("%s is not valid before %s", c.certFile, leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("%s expired on %s", c.certFile, leaf.NotAfter)
+	}
+
+	for _, n := range c.dnsNames {
+		if podNames[n] {
+			continue
+		}
+		if err := leaf.VerifyHostname(n); err != nil {
+			return fmt.Errorf("%s does not cover %s", c.certFile, n)
+		}
+	}
+	for _, ip := range c.ipAddresses {
+		if podNames[ip.String()] {
+			continue
+		}
+		if !containsIP(leaf.IPAddresses, []net.IP{ip}) {
+			return fmt.Errorf("%s does not cover %s", c.certFile, ip)
+		}
+	}
+	for _, u := range c.uris {
+		found := false
+		for _, v := range leaf.URIs {
+			if v.String() == u.String() {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s does not cover %s", c.certFile, u)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates found in ca.crt")
+	}
+	intermediates := x509.NewCertPool()
+	for _, ic := range chain[1:] {
+		intermediates.AddCert(ic)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%s is not signed by ca.crt: %s", c.certFile, err)
+	}
+	return nil
+}
+
+// checkLifetime returns an error if the leaf of the PEM encoded chain is
+// valid for longer than max.
+func checkLifetime(chain []byte, max time.Duration) error {
+	certs, err := parseChain(chain)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate found")
+	}
+	leaf := certs[0]
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > max {
+		return fmt.Errorf("certificate is valid for %s (%s to %s), more than the accepted %s",
+			lifetime, leaf.NotBefore.UTC(), leaf.NotAfter.UTC(), max)
+	}
+	return nil
+}
+
+// runValidator executes the program at path with the PEM encoded chain of
+// c on its standard input, and the request name and certificate file name
+// in CERTIFICATE_NAME and CERTIFICATE_FILE. The certificate is refused if
+// the program exits with a non-zero status, whatever it printed is
+// included in the error.
+func runValidator(path string, c *certificate) error {
+	var out bytes.Buffer
+	cmd := exec.Command(path)
+	cmd.Stdin = bytes.NewReader(c.cert)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Env = append(os.Environ(),
+		"CERTIFICATE_NAME="+c.name,
+		"CERTIFICATE_FILE="+c.certFile,
+	)
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("%s: %s: %s", path, err, msg)
+		}
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// matchesRequest returns an error unless the leaf of the PEM encoded chain
+// certifies the public key of the PEM encoded certificate request csr.
+func matchesRequest(chain, csr []byte) error {
+	certs, err := parseChain(chain)
+	if err != nil {
+		return err
+	}
+	req, err := parseRequest(csr)
+	if err != nil {
+		return err
+	}
+	want, err := x509.MarshalPKIXPublicKey(req.PublicKey)
+	if err != nil {
+		return err
+	}
+	got, err := x509.MarshalPKIXPublicKey(certs[0].PublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("certificate for %s does not match the private key", certs[0].Subject)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVerifyCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain(t, key, time.Hour)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// The secret was created by another replica, with its pod IP address
+	// and pod DNS name.
+	podIP := net.ParseIP("10.0.0.2")
+	c := &certificate{
+		keyFile:     "tls.key",
+		certFile:    "tls.crt",
+		dnsNames:    []string{"10-0-0-2.default.pod.cluster.local", "tls-app.default.svc.cluster.local"},
+		ipAddresses: []net.IP{podIP},
+	}
+	podNames := map[string]bool{podIP.String(): true, "10-0-0-2.default.pod.cluster.local": true}
+	if err := verifyCertificate(c, keyPEM, encodeChain(chain[:1]), encodeChain(chain[1:]), podNames); err != nil {
+		t.Errorf("verifyCertificate of a secret shared by replicas: %s", err)
+	}
+	if err := verifyCertificate(c, keyPEM, encodeChain(chain[:1]), encodeChain(chain[1:]), nil); err == nil {
+		t.Error("verifyCertificate of a certificate missing pod names succeeded without podNames")
+	}
+
+	// Service names are the same for every replica, so are checked.
+	c.dnsNames = append(c.dnsNames, "other.default.svc.cluster.local")
+	if err := verifyCertificate(c, keyPEM, encodeChain(chain[:1]), encodeChain(chain[1:]), podNames); err == nil {
+		t.Error("verifyCertificate of a certificate missing a service name succeeded")
+	}
+}
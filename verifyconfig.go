@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// A verifyConfig tells clients of the workload how to verify its server
+// certificate strictly: which CA bundle to trust, which public key to pin
+// and which names to expect.
+type verifyConfig struct {
+	// CAFile is the CA bundle, relative to the directory of the verify
+	// config, if one is written next to it.
+	CAFile string `json:"caFile,omitempty"`
+
+	// SPKIPins are the base64 encoded SHA-256 digests of the subject
+	// public key info of the certificate, as used by HPKP and Envoy's
+	// verify_certificate_spki.
+	SPKIPins []string `json:"spkiPins"`
+
+	DNSNames    []string `json:"dnsNames,omitempty"`
+	IPAddresses []string `json:"ipAddresses,omitempty"`
+	URIs        []string `json:"uris,omitempty"`
+}
+
+// marshalVerifyConfig returns the verify config for c, whose leaf
+// certificate is leaf. The names are those granted rather than requested.
+func marshalVerifyConfig(c *certificate, leaf *x509.Certificate) ([]byte, error) {
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	v := verifyConfig{
+		SPKIPins: []string{base64.StdEncoding.EncodeToString(sum[:])},
+		DNSNames: leaf.DNSNames,
+	}
+	switch {
+	case c.caChainFile != "":
+		v.CAFile = c.caChainFile
+	case secretName != "":
+		v.CAFile = caFileName
+	}
+	for _, ip := range leaf.IPAddresses {
+		v.IPAddresses = append(v.IPAddresses, ip.String())
+	}
+	for _, u := range leaf.URIs {
+		v.URIs = append(v.URIs, u.String())
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}